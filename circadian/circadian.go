@@ -0,0 +1,320 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package circadian moves a set of dimmers along a brightness curve over
+the day.
+
+The curve is a list of keyframes at times of day or relative to sun
+events, computed locally by package schedule; levels between keyframes
+are interpolated linearly:
+
+  c := circadian.New(37.42, -122.08, []circadian.Keyframe{
+    circadian.AtSun(schedule.Sunrise, 0, 40),
+    circadian.At(12, 0, 100),
+    circadian.AtSun(schedule.Sunset, time.Hour, 60),
+    circadian.At(23, 0, 10),
+  }, conn.Dimmer(12), conn.Dimmer(14))
+  log.Fatal(c.Run(ctx))
+
+Rather than polling, each dimmer is sent one long fade at a time, up to
+Step or the next keyframe, which the repeater carries out on its own.
+
+Only dimmers that are on follow the curve. A dimmer whose last reported
+level is 0 is left off, even if the curve itself faded it to 0, until
+it is turned on again.
+
+A level change that was not sent through the connection, such as a
+keypad press, is treated as a manual override: the controller leaves
+that dimmer alone for Pause after the last such change, then fades it
+back onto the curve.
+*/
+package circadian
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"time"
+
+	"github.com/spearce/lutron"
+	"github.com/spearce/lutron/schedule"
+)
+
+const (
+	// Default time a dimmer is left alone after a manual change.
+	DefaultPause = time.Hour
+
+	// Default longest fade sent to a dimmer.
+	DefaultStep = 30 * time.Minute
+
+	// Shortest fade sent, so a dense curve does not flood the repeater.
+	minStep = time.Minute
+
+	// Longest sleep between checks of the wall clock.
+	maxSleep = time.Minute
+
+	// Delay before resending a fade the command queue rejected.
+	retryDelay = time.Second
+)
+
+// Level of the curve at a time of day, or at an offset from a sun event.
+type Keyframe struct {
+	// Time since local midnight; ignored if Sun is set.
+	Time time.Duration
+
+	Sun    schedule.SunEvent
+	Offset time.Duration
+
+	Level uint8
+}
+
+// Keyframe at hour:minute local time.
+func At(hour, minute int, level uint8) Keyframe {
+	return Keyframe{
+		Time:  time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute,
+		Level: level,
+	}
+}
+
+// Keyframe at offset from a sun event.
+func AtSun(e schedule.SunEvent, offset time.Duration, level uint8) Keyframe {
+	return Keyframe{Sun: e, Offset: offset, Level: level}
+}
+
+// Moves dimmers along a curve.
+type Controller struct {
+	// Logger for overrides; slog.Default() if nil.
+	Logger *slog.Logger
+
+	// Location of keyframe times; time.Local if nil.
+	Location *time.Location
+
+	// Time a dimmer is left alone after a manual change; DefaultPause
+	// if 0.
+	Pause time.Duration
+
+	// Longest fade sent to a dimmer; DefaultStep if 0. Shorter steps
+	// follow a curved path more closely.
+	Step time.Duration
+
+	lat, lon  float64
+	keyframes []Keyframe
+	dimmers   []*lutron.Dimmer
+}
+
+// Create a controller for dimmers at latitude lat and longitude lon,
+// in degrees with north and east positive.
+func New(lat, lon float64, keyframes []Keyframe, dimmers ...*lutron.Dimmer) *Controller {
+	return &Controller{
+		lat:       lat,
+		lon:       lon,
+		keyframes: keyframes,
+		dimmers:   dimmers,
+	}
+}
+
+type point struct {
+	at    time.Time
+	level uint8
+}
+
+// Keyframes of the calendar day containing t, in time order.
+func (c *Controller) points(t time.Time) []point {
+	t = t.In(c.location())
+	y, m, d := t.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+
+	var r []point
+	for _, k := range c.keyframes {
+		at := midnight.Add(k.Time)
+		if k.Sun != schedule.NoSunEvent {
+			s, ok := schedule.SunTime(k.Sun, midnight.Add(12*time.Hour), c.lat, c.lon)
+			if !ok {
+				continue
+			}
+			at = s.Add(k.Offset)
+		}
+		r = append(r, point{at, k.Level})
+	}
+	sort.SliceStable(r, func(i, j int) bool { return r[i].at.Before(r[j].at) })
+	return r
+}
+
+// Keyframes surrounding the day of t.
+func (c *Controller) around(t time.Time) []point {
+	t = t.In(c.location())
+	var r []point
+	for i := -1; i <= 1; i++ {
+		r = append(r, c.points(t.AddDate(0, 0, i))...)
+	}
+	return r
+}
+
+// Level of the curve at t.
+func (c *Controller) Level(t time.Time) uint8 {
+	p := c.around(t)
+	if len(p) == 0 {
+		return 0
+	}
+	i := sort.Search(len(p), func(i int) bool { return p[i].at.After(t) })
+	switch {
+	case i == 0:
+		return p[0].level
+	case i == len(p):
+		return p[len(p)-1].level
+	}
+
+	a, b := p[i-1], p[i]
+	span := b.at.Sub(a.at)
+	if span <= 0 {
+		return b.level
+	}
+	f := float64(t.Sub(a.at)) / float64(span)
+	return uint8(float64(a.level) + f*(float64(b.level)-float64(a.level)) + 0.5)
+}
+
+// End of the fade starting at t: the next keyframe, or t+Step.
+func (c *Controller) segmentEnd(t time.Time) time.Time {
+	step := c.Step
+	if step <= 0 {
+		step = DefaultStep
+	}
+	if step > lutron.MaxFade {
+		step = lutron.MaxFade
+	}
+	end := t.Add(step)
+	for _, p := range c.around(t) {
+		if p.at.After(t) && p.at.Before(end) {
+			end = p.at
+			break
+		}
+	}
+	if end.Sub(t) < minStep {
+		end = t.Add(minStep)
+	}
+	return end
+}
+
+func (c *Controller) location() *time.Location {
+	if c.Location != nil {
+		return c.Location
+	}
+	return time.Local
+}
+
+func (c *Controller) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+func (c *Controller) pause() time.Duration {
+	if c.Pause > 0 {
+		return c.Pause
+	}
+	return DefaultPause
+}
+
+// Controller's view of one dimmer.
+type zone struct {
+	d      *lutron.Dimmer
+	known  bool      // Level has been reported.
+	level  uint8     // Last reported level.
+	sent   bool      // A fade was sent and has not been overridden.
+	until  time.Time // End of the fade in progress.
+	paused time.Time // End of a manual override.
+}
+
+// Adjust the dimmers until ctx is done, returning ctx.Err().
+func (c *Controller) Run(ctx context.Context) error {
+	levels := make(chan lutron.LevelChange, 16)
+	zones := make(map[*lutron.Dimmer]*zone)
+	for _, d := range c.dimmers {
+		if zones[d] != nil {
+			continue
+		}
+		zones[d] = &zone{d: d}
+		sub := d.Subscribe(levels, lutron.MonitorOptions{})
+		defer sub.Unsubscribe()
+	}
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case lc := <-levels:
+			z := zones[lc.Dimmer]
+			if z == nil || lc.Stale {
+				break
+			}
+			// A first known level is not a manual change.
+			manual := lc.Source != lutron.SourceCommand && lc.Source != lutron.SourceQuery
+			if z.known && manual {
+				if z.sent {
+					c.logger().Info("circadian override", "id", z.d.Id(),
+						"level", lc.Level, "source", lc.Source,
+						"resume", time.Now().Add(c.pause()))
+				}
+				z.sent = false
+				z.paused = time.Now().Add(c.pause())
+			}
+			z.known, z.level = true, lc.Level
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		now := time.Now()
+		next := now.Add(maxSleep)
+		for _, z := range zones {
+			switch {
+			case !z.known || z.level == 0:
+				continue
+			case now.Before(z.paused):
+				next = earliest(next, z.paused)
+				continue
+			case z.sent && now.Before(z.until):
+				next = earliest(next, z.until)
+				continue
+			}
+
+			end := c.segmentEnd(now)
+			if !queued(z.d.Fade(c.Level(end), end.Sub(now))) {
+				next = earliest(next, now.Add(retryDelay))
+				continue
+			}
+			z.until, z.sent = end, true
+			next = earliest(next, end)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(next))
+	}
+}
+
+// Whether the fade replying on r was queued; a rejected fade's channel
+// is closed at once.
+func queued(r chan uint8) bool {
+	select {
+	case _, ok := <-r:
+		return ok
+	default:
+		return true
+	}
+}
+
+func earliest(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,82 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circadian
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spearce/lutron/schedule"
+)
+
+var day = time.Date(2024, 6, 21, 0, 0, 0, 0, time.UTC)
+
+// Time of day on day, as "15:04:05".
+func clock(s string) time.Time {
+	t, err := time.Parse("15:04:05", s)
+	if err != nil {
+		panic(err)
+	}
+	return day.Add(t.Sub(time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)))
+}
+
+func testController(keyframes ...Keyframe) *Controller {
+	c := New(0, 0, keyframes)
+	c.Location = time.UTC
+	return c
+}
+
+func TestLevel(t *testing.T) {
+	curve := []Keyframe{At(6, 0, 0), At(12, 0, 100), At(18, 0, 50)}
+	for _, tc := range []struct {
+		name      string
+		keyframes []Keyframe
+		lat       float64
+		at        string
+		want      uint8
+	}{
+		{"no keyframes", nil, 0, "12:00:00", 0},
+		{"keyframe", curve, 0, "12:00:00", 100},
+		{"rising", curve, 0, "09:00:00", 50},
+		{"falling", curve, 0, "15:00:00", 75},
+		{"rounded down", curve, 0, "06:01:30", 0},
+		{"rounded up", curve, 0, "06:02:00", 1},
+		{"after last", curve, 0, "21:00:00", 38},
+		{"before first", curve, 0, "03:00:00", 13},
+		{"single keyframe", []Keyframe{At(12, 0, 40)}, 0, "03:00:00", 40},
+		{"polar day", append([]Keyframe{AtSun(schedule.Sunset, 0, 0)}, curve...), 89, "21:00:00", 38},
+	} {
+		c := testController(tc.keyframes...)
+		c.lat = tc.lat
+		if got := c.Level(clock(tc.at)); got != tc.want {
+			t.Errorf("%s: Level(%s) = %d, want %d", tc.name, tc.at, got, tc.want)
+		}
+	}
+}
+
+func TestSegmentEnd(t *testing.T) {
+	curve := []Keyframe{At(6, 0, 0), At(12, 0, 100), At(18, 0, 50)}
+	for _, tc := range []struct {
+		name string
+		step time.Duration
+		at   string
+		want time.Time
+	}{
+		{"step", 0, "09:00:00", clock("09:30:00")},
+		{"next keyframe", 0, "11:50:00", clock("12:00:00")},
+		{"at keyframe", 0, "12:00:00", clock("12:30:00")},
+		{"shortest step", 0, "11:59:30", clock("12:00:30")},
+		{"longer step", 2 * time.Hour, "13:00:00", clock("15:00:00")},
+		{"next day", 10 * time.Hour, "23:00:00", clock("03:00:00").AddDate(0, 0, 1)},
+		{"longest fade", 10 * time.Hour, "19:00:00", clock("23:00:00")},
+	} {
+		c := testController(curve...)
+		c.Step = tc.step
+		if got := c.segmentEnd(clock(tc.at)); !got.Equal(tc.want) {
+			t.Errorf("%s: segmentEnd(%s) = %v, want %v", tc.name, tc.at, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Command lutron-httpd serves the HTTP/JSON API of package httpapi for a
+RadioRA2 main repeater, so that web dashboards and phones can control
+the system without a Go client.
+
+  lutron-httpd -listen :8080 -addr 192.168.1.5 -user lutron -pass integration \
+    -http-user admin -http-pass secret
+
+The repeater address and credentials may also be given in LUTRON_ADDR,
+LUTRON_USER and LUTRON_PASS, and the API credentials in LUTRON_HTTP_USER
+and LUTRON_HTTP_PASS. Without -http-user the API, which can control
+every light, is open to anyone who can reach the listen address.
+Prometheus metrics are served at /metrics when -metrics is set.
+*/
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/spearce/lutron"
+	"github.com/spearce/lutron/httpapi"
+	"github.com/spearce/lutron/metrics"
+)
+
+var (
+	listen      = flag.String("listen", ":8080", "HTTP listen address")
+	addr        = flag.String("addr", os.Getenv("LUTRON_ADDR"), "main repeater address ($LUTRON_ADDR)")
+	user        = flag.String("user", os.Getenv("LUTRON_USER"), "integration user ($LUTRON_USER)")
+	pass        = flag.String("pass", os.Getenv("LUTRON_PASS"), "integration password ($LUTRON_PASS)")
+	httpUser    = flag.String("http-user", os.Getenv("LUTRON_HTTP_USER"), "user required by the API ($LUTRON_HTTP_USER)")
+	httpPass    = flag.String("http-pass", os.Getenv("LUTRON_HTTP_PASS"), "password required by the API ($LUTRON_HTTP_PASS)")
+	names       = flag.String("names", "", "YAML or JSON names file")
+	database    = flag.Bool("db", false, "load names from the repeater's integration report")
+	stateFile   = flag.String("state", "", "file caching levels across restarts")
+	allowOrigin = flag.String("cors", "", "Access-Control-Allow-Origin for browser clients")
+	withMetrics = flag.Bool("metrics", false, "serve Prometheus metrics at /metrics")
+)
+
+func main() {
+	flag.Parse()
+	if *addr == "" || *user == "" {
+		log.Fatal("repeater address and user are required (see -addr, -user)")
+	}
+
+	var opts []lutron.Option
+	if *stateFile != "" {
+		opts = append(opts, lutron.WithStateFile(*stateFile))
+	}
+	conn, err := lutron.Dial(*addr, *user, *pass, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	if *database {
+		if _, err := conn.LoadDatabase(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *names != "" {
+		if err := conn.LoadNames(*names); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	api := httpapi.New(conn)
+	api.AllowOrigin = *allowOrigin
+	api.User, api.Password = *httpUser, *httpPass
+	if *httpUser == "" {
+		log.Printf("warning: API on %s does not require authentication (see -http-user)", *listen)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", api)
+	if *withMetrics {
+		mux.Handle("/metrics", metrics.New(conn).Handler())
+	}
+	log.Printf("serving on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, mux))
+}
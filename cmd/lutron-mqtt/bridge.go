@@ -0,0 +1,324 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spearce/lutron"
+)
+
+// Subset of an MQTT client used by the bridge. It is implemented by
+// pahoClient for a real broker, by printClient for -dry-run and by
+// fakeBroker in the tests.
+type Client interface {
+	// Publish payload to topic at least once.
+	Publish(topic string, payload []byte, retain bool) error
+
+	// Call handler for each message received on topics matching filter,
+	// which may contain + and # wildcards.
+	Subscribe(filter string, handler func(topic string, payload []byte)) error
+
+	// Call f after each reconnect to the broker, which may have lost
+	// retained messages while the client was away.
+	OnReconnect(f func())
+}
+
+// Relays events and commands between a connection and an MQTT broker.
+//
+// State topics, below the prefix:
+//
+//   output/{id}/level               0-100, retained
+//   output/{id}/state               ON or OFF, retained
+//   keypad/{id}/button/{n}/action   press or release
+//   keypad/{id}/button/{n}/led      off, on, flash or rapid, retained
+//   group/{id}/occupancy            occupied, unoccupied or unknown, retained
+//
+// Command topics:
+//
+//   output/{id}/set                 ON or OFF
+//   output/{id}/level/set           45, or {"level": 45, "fade": 2.5}
+//   keypad/{id}/button/{n}/press    any payload
+type bridge struct {
+	conn   *lutron.Conn
+	client Client
+	prefix string
+
+	// Home Assistant discovery prefix; discovery is disabled if empty.
+	discovery string
+
+	// Outputs registered by name as a Switch, set by start.
+	switches map[int]bool
+
+	// Last LED state published, as keypads only cache monitored LEDs.
+	mu   sync.Mutex
+	leds map[ledKey]uint8
+}
+
+type ledKey struct {
+	keypad int
+	button uint8
+}
+
+// Subscribe to command topics and publish discovery and current state,
+// publishing them again whenever the client reconnects.
+func (b *bridge) start() error {
+	b.switches = make(map[int]bool)
+	for _, name := range b.conn.ListNames() {
+		if obj, _ := b.conn.Lookup(name); obj != nil {
+			if _, ok := obj.(*lutron.Switch); ok {
+				d, _ := b.conn.LookupDimmer(name)
+				b.switches[d.Id()] = true
+			}
+		}
+	}
+
+	subs := map[string]func(string, []byte){
+		b.topic("output/+/set"):            b.setOutput,
+		b.topic("output/+/level/set"):      b.setLevel,
+		b.topic("keypad/+/button/+/press"): b.press,
+	}
+	if b.discovery != "" {
+		// Home Assistant discards discovered entities when it restarts.
+		subs[b.discovery+"/status"] = func(_ string, p []byte) {
+			if string(p) == "online" {
+				b.announce()
+			}
+		}
+	}
+	for filter, h := range subs {
+		if err := b.client.Subscribe(filter, h); err != nil {
+			return err
+		}
+	}
+	b.client.OnReconnect(func() { b.republish() })
+	return b.republish()
+}
+
+// Publish discovery, the cached state of every output and LED, and the
+// bridge's availability.
+func (b *bridge) republish() error {
+	if b.discovery != "" {
+		b.announce()
+	}
+	for _, d := range b.conn.Dimmers() {
+		if l, _, ok := d.CachedLevel(); ok {
+			b.publishLevel(d.Id(), float64(l))
+		}
+	}
+	leds := make(map[ledKey]uint8)
+	for _, k := range b.conn.Keypads() {
+		for n, s := range k.CachedLeds() {
+			leds[ledKey{k.Id(), n}] = s
+		}
+	}
+	b.mu.Lock()
+	for l, s := range b.leds {
+		leds[l] = s
+	}
+	b.mu.Unlock()
+	for l, s := range leds {
+		b.publishLed(l.keypad, l.button, s)
+	}
+	return b.publish("status", "online", true)
+}
+
+// Publish events until the channel is closed.
+func (b *bridge) run(events chan lutron.Event) {
+	for e := range events {
+		switch e := e.(type) {
+		case *lutron.OutputLevelEvent:
+			b.publishLevel(e.Id(), e.Level)
+		case *lutron.ButtonEvent:
+			switch e.Action {
+			case lutron.ButtonPress:
+				b.publish(buttonTopic(e.Id(), e.Button, "action"), "press", false)
+			case lutron.ButtonRelease:
+				b.publish(buttonTopic(e.Id(), e.Button, "action"), "release", false)
+			}
+		case *lutron.LedEvent:
+			b.publishLed(e.Id(), e.Button, e.State)
+		case *lutron.GroupEvent:
+			b.publish(fmt.Sprintf("group/%d/occupancy", e.Id()), occupancy(e.State), true)
+		}
+	}
+}
+
+func (b *bridge) publishLevel(id int, level float64) {
+	state := "OFF"
+	if level > 0 {
+		state = "ON"
+	}
+	b.publish(fmt.Sprintf("output/%d/level", id), strconv.FormatFloat(level, 'f', -1, 64), true)
+	b.publish(fmt.Sprintf("output/%d/state", id), state, true)
+}
+
+func (b *bridge) publishLed(keypad int, button, state uint8) {
+	b.mu.Lock()
+	if b.leds == nil {
+		b.leds = make(map[ledKey]uint8)
+	}
+	b.leds[ledKey{keypad, button}] = state
+	b.mu.Unlock()
+	b.publish(buttonTopic(keypad, button, "led"), ledName(state), true)
+}
+
+func (b *bridge) publish(topic, payload string, retain bool) error {
+	err := b.client.Publish(b.topic(topic), []byte(payload), retain)
+	if err != nil {
+		log.Printf("publish %s: %v", topic, err)
+	}
+	return err
+}
+
+func (b *bridge) topic(t string) string {
+	return b.prefix + "/" + t
+}
+
+func buttonTopic(keypad int, button uint8, t string) string {
+	return fmt.Sprintf("keypad/%d/button/%d/%s", keypad, button, t)
+}
+
+// Handle ON or OFF for a dimmer or switch.
+func (b *bridge) setOutput(topic string, payload []byte) {
+	id, ok := b.topicId(topic, 1)
+	if !ok {
+		return
+	}
+	d, ok := b.output(topic, id)
+	if !ok {
+		return
+	}
+	var on, off func() chan uint8
+	if b.switches[id] {
+		s := b.conn.Switch(id)
+		on, off = s.On, s.Off
+	} else {
+		on, off = d.On, d.Off
+	}
+	switch strings.ToUpper(strings.TrimSpace(string(payload))) {
+	case "ON":
+		b.check(topic, on())
+	case "OFF":
+		b.check(topic, off())
+	default:
+		log.Printf("%s: invalid payload %q", topic, payload)
+	}
+}
+
+// Handle a level, optionally with a fade in seconds.
+func (b *bridge) setLevel(topic string, payload []byte) {
+	id, ok := b.topicId(topic, 1)
+	if !ok {
+		return
+	}
+	d, ok := b.output(topic, id)
+	if !ok {
+		return
+	}
+	var req struct {
+		Level *float64 `json:"level"`
+		Fade  *float64 `json:"fade"`
+	}
+	if l, err := strconv.ParseFloat(strings.TrimSpace(string(payload)), 64); err == nil {
+		req.Level = &l
+	} else if err := json.Unmarshal(payload, &req); err != nil || req.Level == nil {
+		log.Printf("%s: invalid payload %q", topic, payload)
+		return
+	}
+	if *req.Level < 0 || *req.Level > 100 {
+		log.Printf("%s: level %v out of range", topic, *req.Level)
+		return
+	}
+
+	fade := d.DefaultFade()
+	if req.Fade != nil && *req.Fade >= 0 {
+		fade = time.Duration(*req.Fade * float64(time.Second))
+	}
+	b.check(topic, d.Fade(uint8(*req.Level+0.5), fade))
+}
+
+func (b *bridge) press(topic string, payload []byte) {
+	id, ok := b.topicId(topic, 1)
+	if !ok {
+		return
+	}
+	n, ok := b.topicId(topic, 3)
+	if !ok || n < 1 || n > 25 {
+		log.Printf("%s: invalid button", topic)
+		return
+	}
+	k, ok := b.conn.KnownKeypad(id)
+	if !ok {
+		log.Printf("%s: unknown keypad %d", topic, id)
+		return
+	}
+	b.check(topic, k.Button(uint8(n)).Press())
+}
+
+// Dimmer or switch with integration id, if known to the connection.
+// Commands for unknown ids are ignored rather than creating objects
+// that are then monitored and published.
+func (b *bridge) output(topic string, id int) (*lutron.Dimmer, bool) {
+	d, ok := b.conn.KnownDimmer(id)
+	if !ok {
+		log.Printf("%s: unknown output %d", topic, id)
+	}
+	return d, ok
+}
+
+// Integration id or button number at index i of a topic below the prefix.
+func (b *bridge) topicId(topic string, i int) (int, bool) {
+	n := strings.Split(strings.TrimPrefix(topic, b.prefix+"/"), "/")
+	if i >= len(n) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(n[i])
+	if err != nil {
+		log.Printf("%s: invalid id %q", topic, n[i])
+		return 0, false
+	}
+	return id, true
+}
+
+// Log if a command is not accepted by the repeater.
+func (b *bridge) check(topic string, c chan uint8) {
+	go func() {
+		if _, ok := <-c; !ok {
+			log.Printf("%s: command not accepted by the repeater", topic)
+		}
+	}()
+}
+
+func ledName(s uint8) string {
+	switch s {
+	case lutron.LedOff:
+		return "off"
+	case lutron.LedOn:
+		return "on"
+	case lutron.LedNormalFlash:
+		return "flash"
+	case lutron.LedRapidFlash:
+		return "rapid"
+	}
+	return strconv.Itoa(int(s))
+}
+
+func occupancy(s uint8) string {
+	switch s {
+	case lutron.GroupOccupied:
+		return "occupied"
+	case lutron.GroupUnoccupied:
+		return "unoccupied"
+	}
+	return "unknown"
+}
@@ -0,0 +1,363 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spearce/lutron"
+	"github.com/spearce/lutron/config"
+)
+
+// In-process stand-in for an MQTT broker, delivering published messages
+// to matching subscriptions and keeping retained messages.
+type fakeBroker struct {
+	mu        sync.Mutex
+	retained  map[string]string
+	subs      []fakeSub
+	reconnect func()
+}
+
+type fakeSub struct {
+	filter  string
+	handler func(topic string, payload []byte)
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{retained: make(map[string]string)}
+}
+
+func (f *fakeBroker) Publish(topic string, payload []byte, retain bool) error {
+	f.mu.Lock()
+	if retain {
+		f.retained[topic] = string(payload)
+	}
+	var hs []func(string, []byte)
+	for _, s := range f.subs {
+		if matchTopic(s.filter, topic) {
+			hs = append(hs, s.handler)
+		}
+	}
+	f.mu.Unlock()
+	for _, h := range hs {
+		h(topic, payload)
+	}
+	return nil
+}
+
+func (f *fakeBroker) Subscribe(filter string, handler func(topic string, payload []byte)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.subs = append(f.subs, fakeSub{filter, handler})
+	return nil
+}
+
+func (f *fakeBroker) OnReconnect(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reconnect = fn
+}
+
+// Simulate a broker restart that loses retained messages.
+func (f *fakeBroker) restart() {
+	f.mu.Lock()
+	f.retained = make(map[string]string)
+	fn := f.reconnect
+	f.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+func (f *fakeBroker) get(topic string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p, ok := f.retained[topic]
+	return p, ok
+}
+
+// Wait for topic to be retained with payload.
+func (f *fakeBroker) await(t *testing.T, topic, payload string) {
+	t.Helper()
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); time.Sleep(time.Millisecond) {
+		if p, _ := f.get(topic); p == payload {
+			return
+		}
+	}
+	p, ok := f.get(topic)
+	t.Fatalf("%s = %q (retained %v), want %q", topic, p, ok, payload)
+}
+
+func matchTopic(filter, topic string) bool {
+	fs, ts := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || (f != "+" && f != ts[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// Transport standing in for a main repeater: commands are recorded and
+// acknowledged, level queries are answered with 0, and lines may be
+// injected as if reported by the repeater.
+type fakeRepeater struct {
+	lines  chan string
+	closed chan struct{}
+
+	mu   sync.Mutex
+	sent []string
+}
+
+func newFakeRepeater() *fakeRepeater {
+	return &fakeRepeater{lines: make(chan string, 64), closed: make(chan struct{})}
+}
+
+func (r *fakeRepeater) ReadLine() (string, error) {
+	select {
+	case l := <-r.lines:
+		return l, nil
+	case <-r.closed:
+		return "", io.EOF
+	}
+}
+
+func (r *fakeRepeater) WriteLine(l string) error {
+	r.mu.Lock()
+	r.sent = append(r.sent, l)
+	r.mu.Unlock()
+
+	n := strings.Split(l[1:], ",")
+	switch {
+	case strings.HasPrefix(l, "#OUTPUT,"):
+		r.lines <- fmt.Sprintf("~OUTPUT,%s,1,%s.00", n[1], n[3])
+	case l[0] == '#':
+		r.lines <- "~" + l[1:]
+	case strings.HasPrefix(l, "?OUTPUT,"):
+		r.lines <- fmt.Sprintf("~OUTPUT,%s,1,0.00", n[1])
+	}
+	return nil
+}
+
+func (r *fakeRepeater) Close() error {
+	select {
+	case <-r.closed:
+	default:
+		close(r.closed)
+	}
+	return nil
+}
+
+// Wait for the repeater to be sent line.
+func (r *fakeRepeater) await(t *testing.T, line string) {
+	t.Helper()
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); time.Sleep(time.Millisecond) {
+		r.mu.Lock()
+		for _, l := range r.sent {
+			if l == line {
+				r.mu.Unlock()
+				return
+			}
+		}
+		r.mu.Unlock()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t.Fatalf("%q not sent; sent %q", line, r.sent)
+}
+
+func newBridge(t *testing.T) (*bridge, *fakeBroker, *fakeRepeater) {
+	rep := newFakeRepeater()
+	conn, err := lutron.NewConn(rep, lutron.WithCommandRate(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	db, err := config.ParseFile("../../config/testdata/DbXmlInfo.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.AddDatabase(db)
+
+	broker := newFakeBroker()
+	b := &bridge{conn: conn, client: broker, prefix: "lutron", discovery: "homeassistant"}
+	events := conn.Events(lutron.EventFilter{})
+	if err := b.start(); err != nil {
+		t.Fatal(err)
+	}
+	go b.run(events)
+	return b, broker, rep
+}
+
+func TestCommandTopics(t *testing.T) {
+	_, broker, rep := newBridge(t)
+
+	broker.Publish("lutron/output/14/set", []byte("ON"), false)
+	rep.await(t, "#OUTPUT,14,1,100,00.00")
+
+	broker.Publish("lutron/output/12/level/set", []byte("45"), false)
+	rep.await(t, "#OUTPUT,12,1,45,02.00")
+
+	broker.Publish("lutron/output/13/level/set", []byte(`{"level": 30, "fade": 2.5}`), false)
+	rep.await(t, "#OUTPUT,13,1,30,02.50")
+
+	broker.Publish("lutron/keypad/4/button/1/press", nil, false)
+	rep.await(t, "#DEVICE,4,1,3")
+	rep.await(t, "#DEVICE,4,1,4")
+
+	for _, m := range []struct{ topic, payload string }{
+		{"lutron/output/31/set", "DIM"},
+		{"lutron/output/31/level/set", "101"},
+		{"lutron/output/31/level/set", `{"fade": 1}`},
+		{"lutron/keypad/4/button/0/press", ""},
+		{"lutron/output/999/set", "ON"},
+		{"lutron/output/999/level/set", "50"},
+		{"lutron/keypad/999/button/1/press", ""},
+	} {
+		broker.Publish(m.topic, []byte(m.payload), false)
+	}
+	broker.Publish("lutron/output/33/set", []byte("ON"), false)
+	rep.await(t, "#OUTPUT,33,1,100,02.00")
+
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	for _, l := range rep.sent {
+		if strings.HasPrefix(l, "#OUTPUT,31,") || strings.HasPrefix(l, "#DEVICE,4,0,") ||
+			strings.Contains(l, ",999,") {
+			t.Errorf("invalid payload sent %q", l)
+		}
+	}
+}
+
+func TestStatePublishing(t *testing.T) {
+	_, broker, rep := newBridge(t)
+	broker.await(t, "lutron/status", "online")
+
+	rep.lines <- "~OUTPUT,12,1,45.00"
+	broker.await(t, "lutron/output/12/level", "45")
+	broker.await(t, "lutron/output/12/state", "ON")
+
+	rep.lines <- "~OUTPUT,12,1,0.00"
+	broker.await(t, "lutron/output/12/state", "OFF")
+
+	rep.lines <- "~DEVICE,4,81,9,1"
+	broker.await(t, "lutron/keypad/4/button/1/led", "on")
+
+	rep.lines <- "~GROUP,2,3,3"
+	broker.await(t, "lutron/group/2/occupancy", "occupied")
+
+	var actions []string
+	done := make(chan struct{})
+	broker.Subscribe("lutron/keypad/+/button/+/action", func(topic string, p []byte) {
+		actions = append(actions, topic+" "+string(p))
+		if len(actions) == 2 {
+			close(done)
+		}
+	})
+	rep.lines <- "~DEVICE,6,5,3"
+	rep.lines <- "~DEVICE,6,5,4"
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("actions = %q", actions)
+	}
+	want := "lutron/keypad/6/button/5/action press,lutron/keypad/6/button/5/action release"
+	if got := strings.Join(actions, ","); got != want {
+		t.Errorf("actions = %s, want %s", got, want)
+	}
+	if _, ok := broker.get("lutron/keypad/6/button/5/action"); ok {
+		t.Error("button action retained")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	_, broker, _ := newBridge(t)
+
+	config := func(topic string) map[string]interface{} {
+		t.Helper()
+		p, ok := broker.get(topic)
+		if !ok {
+			t.Fatalf("%s not retained", topic)
+		}
+		var c map[string]interface{}
+		if err := json.Unmarshal([]byte(p), &c); err != nil {
+			t.Fatalf("%s: %v", topic, err)
+		}
+		return c
+	}
+
+	light := config("homeassistant/light/lutron/output_12/config")
+	for k, v := range map[string]interface{}{
+		"unique_id":                "lutron_output_12",
+		"command_topic":            "lutron/output/12/set",
+		"state_topic":              "lutron/output/12/state",
+		"brightness_command_topic": "lutron/output/12/level/set",
+		"brightness_state_topic":   "lutron/output/12/level",
+		"availability_topic":       "lutron/status",
+	} {
+		if light[k] != v {
+			t.Errorf("light %s = %v, want %v", k, light[k], v)
+		}
+	}
+
+	sw := config("homeassistant/switch/lutron/output_14/config")
+	if sw["command_topic"] != "lutron/output/14/set" || sw["brightness_command_topic"] != nil {
+		t.Errorf("switch = %v", sw)
+	}
+	if _, ok := broker.get("homeassistant/light/lutron/output_14/config"); ok {
+		t.Error("switch announced as a light")
+	}
+
+	trigger := config("homeassistant/device_trigger/lutron/keypad_4_button_1_press/config")
+	if trigger["topic"] != "lutron/keypad/4/button/1/action" || trigger["payload"] != "press" {
+		t.Errorf("trigger = %v", trigger)
+	}
+	led := config("homeassistant/binary_sensor/lutron/keypad_4_led_1/config")
+	if led["state_topic"] != "lutron/keypad/4/button/1/led" {
+		t.Errorf("led = %v", led)
+	}
+
+	// Home Assistant discards discovered entities when it restarts.
+	broker.mu.Lock()
+	delete(broker.retained, "homeassistant/light/lutron/output_12/config")
+	broker.mu.Unlock()
+	broker.Publish("homeassistant/status", []byte("online"), false)
+	config("homeassistant/light/lutron/output_12/config")
+}
+
+func TestReconnectRepublishes(t *testing.T) {
+	_, broker, rep := newBridge(t)
+
+	rep.lines <- "~OUTPUT,13,1,60.00"
+	broker.await(t, "lutron/output/13/level", "60")
+	rep.lines <- "~DEVICE,6,85,9,2"
+	broker.await(t, "lutron/keypad/6/button/5/led", "flash")
+
+	broker.restart()
+	for topic, payload := range map[string]string{
+		"lutron/status":                "online",
+		"lutron/output/13/level":       "60",
+		"lutron/output/13/state":       "ON",
+		"lutron/keypad/6/button/5/led": "flash",
+	} {
+		if p, _ := broker.get(topic); p != payload {
+			t.Errorf("after reconnect %s = %q, want %q", topic, p, payload)
+		}
+	}
+	if _, ok := broker.get("homeassistant/light/lutron/output_13/config"); !ok {
+		t.Error("discovery not republished after reconnect")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/spearce/lutron"
+)
+
+// Home Assistant device registry entry, grouping entities in the UI.
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+// Publish Home Assistant MQTT discovery payloads: a light or switch for
+// every output, and a device trigger and LED binary sensor for every
+// named keypad button. Outputs known only by id are announced under
+// their integration id.
+func (b *bridge) announce() {
+	outputs := make(map[int]bool)
+	for _, name := range b.conn.ListNames() {
+		obj, err := b.conn.Lookup(name)
+		if err != nil {
+			continue
+		}
+		switch v := obj.(type) {
+		case *lutron.Dimmer, *lutron.Switch, *lutron.HybridKeypad:
+			d, _ := b.conn.LookupDimmer(name)
+			b.announceOutput(d.Id(), name)
+			outputs[d.Id()] = true
+		case *lutron.KeypadButton:
+			b.announceButton(v, name)
+		}
+	}
+	for _, d := range b.conn.Dimmers() {
+		if !outputs[d.Id()] {
+			b.announceOutput(d.Id(), fmt.Sprintf("Output %d", d.Id()))
+		}
+	}
+}
+
+func (b *bridge) announceOutput(id int, name string) {
+	object := fmt.Sprintf("output_%d", id)
+	c := map[string]interface{}{
+		"name":               nil, // Entity takes the device's name.
+		"unique_id":          "lutron_" + object,
+		"device":             b.device(object, name),
+		"availability_topic": b.topic("status"),
+		"command_topic":      b.topic(fmt.Sprintf("output/%d/set", id)),
+		"state_topic":        b.topic(fmt.Sprintf("output/%d/state", id)),
+	}
+	component := "switch"
+	if !b.switches[id] {
+		component = "light"
+		c["brightness_command_topic"] = b.topic(fmt.Sprintf("output/%d/level/set", id))
+		c["brightness_state_topic"] = b.topic(fmt.Sprintf("output/%d/level", id))
+		c["brightness_scale"] = 100
+		c["on_command_type"] = "brightness"
+	}
+	b.publishConfig(component, object, c)
+}
+
+func (b *bridge) announceButton(btn *lutron.KeypadButton, name string) {
+	k, n := btn.Keypad().Id(), btn.Id()
+	keypad := fmt.Sprintf("keypad_%d", k)
+	device := b.device(keypad, b.keypadName(k))
+	subtype := fmt.Sprintf("button_%d", n)
+
+	for _, action := range []string{"press", "release"} {
+		b.publishConfig("device_trigger", fmt.Sprintf("%s_%s_%s", keypad, subtype, action),
+			map[string]interface{}{
+				"automation_type": "trigger",
+				"topic":           b.topic(buttonTopic(k, n, "action")),
+				"payload":         action,
+				"type":            "button_short_" + action,
+				"subtype":         subtype,
+				"device":          device,
+			})
+	}
+
+	object := fmt.Sprintf("%s_led_%d", keypad, n)
+	b.publishConfig("binary_sensor", object, map[string]interface{}{
+		"name":               name + " LED",
+		"unique_id":          "lutron_" + object,
+		"device":             device,
+		"availability_topic": b.topic("status"),
+		"state_topic":        b.topic(buttonTopic(k, n, "led")),
+		"value_template":     "{{ 'OFF' if value == 'off' else 'ON' }}",
+		"entity_category":    "diagnostic",
+	})
+}
+
+func (b *bridge) keypadName(id int) string {
+	if n := b.conn.NameOfDevice(id); n != "" {
+		return n
+	}
+	return fmt.Sprintf("Keypad %d", id)
+}
+
+func (b *bridge) device(object, name string) *haDevice {
+	return &haDevice{
+		Identifiers:  []string{"lutron_" + object},
+		Name:         name,
+		Manufacturer: "Lutron",
+	}
+}
+
+func (b *bridge) publishConfig(component, object string, config map[string]interface{}) {
+	p, err := json.Marshal(config)
+	if err != nil {
+		log.Printf("discovery %s: %v", object, err)
+		return
+	}
+	topic := fmt.Sprintf("%s/%s/lutron/%s/config", b.discovery, component, object)
+	if err := b.client.Publish(topic, p, true); err != nil {
+		log.Printf("publish %s: %v", topic, err)
+	}
+}
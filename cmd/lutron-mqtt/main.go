@@ -0,0 +1,118 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Command lutron-mqtt bridges a RadioRA2 main repeater to an MQTT broker.
+
+  lutron-mqtt -addr 192.168.1.5 -user lutron -pass integration \
+    -broker tcp://localhost:1883 -db
+
+Every dimmer level, keypad button press and LED state is published below
+the topic prefix (default "lutron"), and commands published to
+output/{id}/set, output/{id}/level/set and keypad/{id}/button/{n}/press
+are sent to the repeater. Unless -discovery is empty, Home Assistant MQTT
+discovery payloads announce a light or switch for each output and a
+device trigger and LED binary sensor for each named keypad button.
+Load names with -db or -names so that switches and buttons are known.
+
+With -dry-run, messages are printed instead of sent to a broker.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/spearce/lutron"
+)
+
+var (
+	addr      = flag.String("addr", os.Getenv("LUTRON_ADDR"), "main repeater address ($LUTRON_ADDR)")
+	user      = flag.String("user", os.Getenv("LUTRON_USER"), "integration user ($LUTRON_USER)")
+	pass      = flag.String("pass", os.Getenv("LUTRON_PASS"), "integration password ($LUTRON_PASS)")
+	names     = flag.String("names", "", "YAML or JSON names file")
+	database  = flag.Bool("db", false, "load names from the repeater's integration report")
+	stateFile = flag.String("state", "", "file caching levels across restarts")
+
+	broker     = flag.String("broker", "tcp://localhost:1883", "MQTT broker URL")
+	brokerUser = flag.String("broker-user", os.Getenv("MQTT_USER"), "MQTT user ($MQTT_USER)")
+	brokerPass = flag.String("broker-pass", os.Getenv("MQTT_PASS"), "MQTT password ($MQTT_PASS)")
+	clientID   = flag.String("client-id", "lutron-mqtt", "MQTT client id")
+	prefix     = flag.String("prefix", "lutron", "topic prefix")
+	discovery  = flag.String("discovery", "homeassistant", "Home Assistant discovery prefix; empty disables")
+	dryRun     = flag.Bool("dry-run", false, "print messages instead of connecting to the broker")
+)
+
+func main() {
+	flag.Parse()
+	if *addr == "" || *user == "" {
+		log.Fatal("repeater address and user are required (see -addr, -user)")
+	}
+
+	var opts []lutron.Option
+	if *stateFile != "" {
+		opts = append(opts, lutron.WithStateFile(*stateFile))
+	}
+	conn, err := lutron.Dial(*addr, *user, *pass, opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	if *database {
+		if _, err := conn.LoadDatabase(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *names != "" {
+		if err := conn.LoadNames(*names); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var client Client = printClient{}
+	if !*dryRun {
+		p, err := dialMQTT(*broker, *clientID, *brokerUser, *brokerPass, *prefix+"/status")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer p.Close()
+		client = p
+	}
+
+	b := &bridge{
+		conn:      conn,
+		client:    client,
+		prefix:    *prefix,
+		discovery: *discovery,
+	}
+	events := conn.Events(lutron.EventFilter{})
+	if err := b.start(); err != nil {
+		log.Fatal(err)
+	}
+	go b.run(events)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	b.publish("status", "offline", true)
+}
+
+// Client printing published messages, for -dry-run.
+type printClient struct{}
+
+func (printClient) Publish(topic string, payload []byte, retain bool) error {
+	fmt.Printf("%s %s\n", topic, payload)
+	return nil
+}
+
+func (printClient) Subscribe(filter string, handler func(topic string, payload []byte)) error {
+	return nil
+}
+
+func (printClient) OnReconnect(f func()) {}
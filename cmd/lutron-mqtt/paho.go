@@ -0,0 +1,107 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Time allowed for the broker to acknowledge a request.
+const brokerTimeout = 10 * time.Second
+
+// Client connected to an MQTT broker. Subscriptions are restored and
+// the birth message is published again after a reconnect.
+type pahoClient struct {
+	c mqtt.Client
+
+	mu        sync.Mutex
+	subs      map[string]mqtt.MessageHandler
+	reconnect func()
+}
+
+// Connect to broker, e.g. "tcp://localhost:1883". The broker publishes
+// "offline" to willTopic if the bridge disconnects unexpectedly.
+func dialMQTT(broker, clientID, user, pass, willTopic string) (*pahoClient, error) {
+	p := &pahoClient{subs: make(map[string]mqtt.MessageHandler)}
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(user).
+		SetPassword(pass).
+		SetAutoReconnect(true).
+		SetWill(willTopic, "offline", 1, true).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Printf("mqtt connection lost: %v", err)
+		}).
+		SetOnConnectHandler(func(c mqtt.Client) {
+			p.resubscribe()
+			c.Publish(willTopic, 1, true, "online")
+			p.reconnected()
+		})
+	p.c = mqtt.NewClient(opts)
+	if err := wait(p.c.Connect()); err != nil {
+		return nil, fmt.Errorf("mqtt %s: %v", broker, err)
+	}
+	return p, nil
+}
+
+func (p *pahoClient) Publish(topic string, payload []byte, retain bool) error {
+	return wait(p.c.Publish(topic, 1, retain, payload))
+}
+
+func (p *pahoClient) Subscribe(filter string, handler func(topic string, payload []byte)) error {
+	h := func(_ mqtt.Client, m mqtt.Message) {
+		handler(m.Topic(), m.Payload())
+	}
+	p.mu.Lock()
+	p.subs[filter] = h
+	p.mu.Unlock()
+	return wait(p.c.Subscribe(filter, 1, h))
+}
+
+func (p *pahoClient) resubscribe() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for filter, h := range p.subs {
+		// Not waited for as this runs on the client's connection goroutine.
+		p.c.Subscribe(filter, 1, h)
+	}
+}
+
+func (p *pahoClient) OnReconnect(f func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reconnect = f
+}
+
+func (p *pahoClient) reconnected() {
+	p.mu.Lock()
+	f := p.reconnect
+	p.mu.Unlock()
+	if f != nil {
+		// Publishing waits for the broker, which cannot reply while
+		// this runs on the client's connection goroutine.
+		go f()
+	}
+}
+
+// Disconnect after publishing any messages in flight.
+func (p *pahoClient) Close() {
+	p.c.Disconnect(uint(brokerTimeout / time.Millisecond))
+}
+
+func wait(t mqtt.Token) error {
+	if !t.WaitTimeout(brokerTimeout) {
+		return fmt.Errorf("no reply from broker")
+	}
+	return t.Error()
+}
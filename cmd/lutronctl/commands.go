@@ -0,0 +1,243 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spearce/lutron"
+)
+
+// Time allowed for the repeater to reply.
+const replyTimeout = 10 * time.Second
+
+func level(conn *lutron.Conn, args []string) error {
+	fs := flag.NewFlagSet("level", flag.ContinueOnError)
+	fade := fs.Duration("fade", lutron.DefaultFade, "fade duration")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage
+	}
+
+	d, err := dimmerArg(conn, args[0])
+	if err != nil {
+		return err
+	}
+	if len(args) == 1 {
+		l, err := wait(d.ReadLevel(), replyTimeout)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %d%%\n", outputLabel(conn, d.Id()), l)
+		return nil
+	}
+
+	v, err := strconv.ParseUint(args[1], 10, 8)
+	if err != nil || v > 100 {
+		return fmt.Errorf("invalid level %q", args[1])
+	}
+	l, err := wait(d.Fade(uint8(v), *fade), replyTimeout+*fade)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %d%%\n", outputLabel(conn, d.Id()), l)
+	return nil
+}
+
+func press(conn *lutron.Conn, args []string) error {
+	b, err := buttonArgs(conn, args, 0)
+	if err != nil {
+		return err
+	}
+	_, err = wait(b.Press(), replyTimeout)
+	return err
+}
+
+func led(conn *lutron.Conn, args []string) error {
+	b, err := buttonArgs(conn, args, 1)
+	if err != nil {
+		return err
+	}
+	state, err := ledStateArg(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+	_, err = wait(b.SetLed(state), replyTimeout)
+	return err
+}
+
+func monitor(conn *lutron.Conn, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	events := make(chan lutron.Event)
+	sub := conn.SubscribeEvents(events, lutron.EventFilter{}, lutron.MonitorOptions{})
+	defer sub.Unsubscribe()
+	interrupt := interrupted()
+	defer signal.Stop(interrupt)
+	for {
+		select {
+		case e := <-events:
+			fmt.Println(describe(conn, e))
+		case <-interrupt:
+			return nil
+		}
+	}
+}
+
+func query(conn *lutron.Conn, args []string) error {
+	if len(args) == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), replyTimeout)
+		defer cancel()
+		r, err := conn.Refresh(ctx)
+		if err != nil {
+			return err
+		}
+		for _, d := range conn.Dimmers() {
+			if l, _, ok := d.CachedLevel(); ok {
+				fmt.Printf("%s %d%%\n", outputLabel(conn, d.Id()), l)
+			}
+		}
+		for _, id := range r.Dimmers {
+			fmt.Printf("%s did not reply\n", outputLabel(conn, id))
+		}
+		for _, b := range r.Leds {
+			fmt.Printf("%s LED did not reply\n",
+				buttonLabel(conn, b.Keypad().Id(), b.Id()))
+		}
+		return nil
+	}
+
+	var dimmers []*lutron.Dimmer
+	var replies []chan uint8
+	for _, a := range args {
+		d, err := dimmerArg(conn, a)
+		if err != nil {
+			return err
+		}
+		dimmers = append(dimmers, d)
+		replies = append(replies, d.ReadLevel())
+	}
+	for i, d := range dimmers {
+		l, err := wait(replies[i], replyTimeout)
+		if err != nil {
+			fmt.Printf("%s %v\n", outputLabel(conn, d.Id()), err)
+			continue
+		}
+		fmt.Printf("%s %d%%\n", outputLabel(conn, d.Id()), l)
+	}
+	return nil
+}
+
+func raw(conn *lutron.Conn, args []string) error {
+	fs := flag.NewFlagSet("raw", flag.ContinueOnError)
+	delay := fs.Duration("wait", 2*time.Second, "time to print replies")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	events := make(chan lutron.Event)
+	sub := conn.SubscribeEvents(events, lutron.EventFilter{}, lutron.MonitorOptions{})
+	defer sub.Unsubscribe()
+	for _, line := range args {
+		if err := conn.Send(line); err != nil {
+			return err
+		}
+	}
+	timeout := time.After(*delay)
+	for {
+		select {
+		case e := <-events:
+			fmt.Println(e.Raw())
+		case <-timeout:
+			return nil
+		}
+	}
+}
+
+// Wait for a reply from the repeater.
+func wait(c chan uint8, timeout time.Duration) (uint8, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	v, err := lutron.Wait(ctx, c)
+	switch err {
+	case lutron.ErrQueueFull:
+		return 0, errors.New("command not accepted, try again")
+	case context.DeadlineExceeded:
+		return 0, errors.New("no reply from repeater")
+	}
+	return v, err
+}
+
+func interrupted() chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	return c
+}
+
+// Find an output by integration id or name.
+func dimmerArg(conn *lutron.Conn, s string) (*lutron.Dimmer, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return conn.Dimmer(id), nil
+	}
+	return conn.LookupDimmer(s)
+}
+
+// Find a keypad by integration id or name.
+func keypadArg(conn *lutron.Conn, s string) (*lutron.Keypad, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return conn.Keypad(id), nil
+	}
+	return conn.LookupKeypad(s)
+}
+
+// Find a button from "<keypad> <button>" or a single button name,
+// followed by extra arguments.
+func buttonArgs(conn *lutron.Conn, args []string, extra int) (*lutron.KeypadButton, error) {
+	switch len(args) - extra {
+	case 1:
+		return conn.LookupButton(args[0])
+	case 2:
+		k, err := keypadArg(conn, args[0])
+		if err != nil {
+			return nil, err
+		}
+		if n, err := strconv.ParseUint(args[1], 10, 8); err == nil {
+			return k.Button(uint8(n)), nil
+		}
+		return conn.LookupButton(args[0] + "/" + args[1])
+	}
+	return nil, errUsage
+}
+
+func ledStateArg(s string) (uint8, error) {
+	switch strings.ToLower(s) {
+	case "off", "0":
+		return lutron.LedOff, nil
+	case "on", "1":
+		return lutron.LedOn, nil
+	case "flash", "2":
+		return lutron.LedNormalFlash, nil
+	case "rapid", "3":
+		return lutron.LedRapidFlash, nil
+	}
+	return 0, fmt.Errorf("invalid LED state %q", s)
+}
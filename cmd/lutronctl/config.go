@@ -0,0 +1,98 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/spearce/lutron"
+)
+
+// Connection settings. Values come from, in increasing precedence, the
+// config file, LUTRON_* environment variables and command line flags.
+type config struct {
+	Addr     string `json:"addr"`
+	User     string `json:"user"`
+	Pass     string `json:"pass"`
+	Names    string `json:"names"`    // YAML or JSON file of names.
+	Database bool   `json:"database"` // Load DbXmlInfo.xml from the repeater.
+}
+
+var (
+	configFile = flag.String("config", defaultConfigFile(), "JSON config file")
+	addrFlag   = flag.String("addr", "", "main repeater address ($LUTRON_ADDR)")
+	userFlag   = flag.String("user", "", "integration user ($LUTRON_USER)")
+	passFlag   = flag.String("pass", "", "integration password ($LUTRON_PASS)")
+	namesFlag  = flag.String("names", "", "YAML or JSON names file ($LUTRON_NAMES)")
+	dbFlag     = flag.Bool("db", false, "load names from the repeater's integration report")
+)
+
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "lutronctl.json")
+}
+
+func loadConfig() (*config, error) {
+	var c config
+	if *configFile != "" {
+		b, err := ioutil.ReadFile(*configFile)
+		if err == nil {
+			if err := json.Unmarshal(b, &c); err != nil {
+				return nil, fmt.Errorf("%s: %v", *configFile, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	override(&c.Addr, os.Getenv("LUTRON_ADDR"), *addrFlag)
+	override(&c.User, os.Getenv("LUTRON_USER"), *userFlag)
+	override(&c.Pass, os.Getenv("LUTRON_PASS"), *passFlag)
+	override(&c.Names, os.Getenv("LUTRON_NAMES"), *namesFlag)
+	c.Database = c.Database || *dbFlag
+
+	if c.Addr == "" || c.User == "" {
+		return nil, fmt.Errorf("repeater address and user are required (see -addr, -user)")
+	}
+	return &c, nil
+}
+
+func override(v *string, values ...string) {
+	for _, s := range values {
+		if s != "" {
+			*v = s
+		}
+	}
+}
+
+// Connect and load names as configured.
+func (c *config) dial(opts ...lutron.Option) (*lutron.Conn, error) {
+	conn, err := lutron.Dial(c.Addr, c.User, c.Pass, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if c.Database {
+		if _, err := conn.LoadDatabase(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.Names != "" {
+		if err := conn.LoadNames(c.Names); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
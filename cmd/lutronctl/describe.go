@@ -0,0 +1,182 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spearce/lutron"
+)
+
+// Human readable form of an event, using registered names if known.
+func describe(conn *lutron.Conn, e lutron.Event) string {
+	t := e.Time().Format("15:04:05.000")
+	switch v := e.(type) {
+	case *lutron.OutputLevelEvent:
+		return fmt.Sprintf("%s %s → %s%%", t,
+			outputLabel(conn, v.Id()), formatLevel(v.Level))
+	case *lutron.ButtonEvent:
+		return fmt.Sprintf("%s %s %s", t,
+			buttonLabel(conn, v.Id(), v.Button), buttonAction(v.Action))
+	case *lutron.LedEvent:
+		return fmt.Sprintf("%s %s LED %s", t,
+			buttonLabel(conn, v.Id(), v.Button), ledState(v.State))
+	case *lutron.GroupEvent:
+		return fmt.Sprintf("%s group %d %s", t, v.Id(), groupState(v.State))
+	}
+	if code := strings.TrimPrefix(e.Raw(), "~ERROR,"); code != e.Raw() {
+		return fmt.Sprintf("%s error: %s", t, errorText(code))
+	}
+	return fmt.Sprintf("%s %s", t, e.Raw())
+}
+
+// Human readable form of a command or query sent to the repeater.
+func describeCommand(conn *lutron.Conn, line string) string {
+	if len(line) < 2 {
+		return line
+	}
+	op := line[0]
+	n := strings.Split(line[1:], ",")
+	if len(n) < 3 {
+		return line
+	}
+	id, err := strconv.Atoi(n[1])
+	if err != nil {
+		return line
+	}
+
+	switch n[0] {
+	case "OUTPUT":
+		o := outputLabel(conn, id)
+		switch {
+		case op == '?' && n[2] == "1":
+			return "query " + o
+		case op != '#':
+		case n[2] == "1" && len(n) >= 4:
+			l, err := strconv.ParseFloat(n[3], 64)
+			if err != nil {
+				break
+			}
+			s := fmt.Sprintf("%s → %s%%", o, formatLevel(l))
+			if len(n) >= 5 {
+				if f, err := lutron.ParseFade(n[4]); err == nil {
+					s += " over " + f.String()
+				}
+			}
+			if len(n) >= 6 {
+				if d, err := lutron.ParseFade(n[5]); err == nil && d > 0 {
+					s += " after " + d.String()
+				}
+			}
+			return s
+		case n[2] == "2":
+			return o + " raise"
+		case n[2] == "3":
+			return o + " lower"
+		case n[2] == "4":
+			return o + " stop"
+		}
+
+	case "DEVICE":
+		c, err := strconv.Atoi(n[2])
+		if err != nil {
+			break
+		}
+		switch {
+		case 1 <= c && c <= 25 && op == '#' && len(n) == 4:
+			if a, err := strconv.Atoi(n[3]); err == nil {
+				return fmt.Sprintf("%s %s", buttonLabel(conn, id, uint8(c)), buttonAction(uint8(a)))
+			}
+		case 81 <= c && c <= 95 && len(n) >= 4 && n[3] == "9":
+			b := buttonLabel(conn, id, uint8(c-80))
+			if op == '?' {
+				return "query " + b + " LED"
+			}
+			if len(n) == 5 {
+				if s, err := strconv.Atoi(n[4]); err == nil {
+					return fmt.Sprintf("%s LED → %s", b, ledState(uint8(s)))
+				}
+			}
+		}
+	}
+	return line
+}
+
+func outputLabel(conn *lutron.Conn, id int) string {
+	if n := conn.NameOfOutput(id); n != "" {
+		return n
+	}
+	return fmt.Sprintf("output %d", id)
+}
+
+func buttonLabel(conn *lutron.Conn, keypad int, button uint8) string {
+	if n := conn.NameOfButton(keypad, button); n != "" {
+		return n
+	}
+	k := conn.NameOfDevice(keypad)
+	if k == "" {
+		k = fmt.Sprintf("keypad %d", keypad)
+	}
+	return fmt.Sprintf("%s button %d", k, button)
+}
+
+func formatLevel(l float64) string {
+	return strconv.FormatFloat(l, 'f', -1, 64)
+}
+
+func buttonAction(a uint8) string {
+	switch a {
+	case lutron.ButtonPress:
+		return "pressed"
+	case lutron.ButtonRelease:
+		return "released"
+	}
+	return fmt.Sprintf("action %d", a)
+}
+
+func ledState(s uint8) string {
+	switch s {
+	case lutron.LedOff:
+		return "off"
+	case lutron.LedOn:
+		return "on"
+	case lutron.LedNormalFlash:
+		return "flashing"
+	case lutron.LedRapidFlash:
+		return "flashing rapidly"
+	}
+	return fmt.Sprintf("state %d", s)
+}
+
+func groupState(s uint8) string {
+	switch s {
+	case lutron.GroupOccupied:
+		return "occupied"
+	case lutron.GroupUnoccupied:
+		return "unoccupied"
+	}
+	return "unknown"
+}
+
+func errorText(code string) string {
+	switch code {
+	case "1":
+		return "parameter count mismatch"
+	case "2":
+		return "object does not exist"
+	case "3":
+		return "invalid action number"
+	case "4":
+		return "parameter data out of range"
+	case "5":
+		return "parameter data malformed"
+	case "6":
+		return "unsupported command"
+	}
+	return "code " + code
+}
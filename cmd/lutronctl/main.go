@@ -0,0 +1,148 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Command lutronctl controls a RadioRA2 system from the command line.
+
+  lutronctl [flags] level <output> [value] [-fade 2s]
+  lutronctl [flags] press <keypad> <button>
+  lutronctl [flags] led <keypad> <button> <on|off|flash|rapid>
+  lutronctl [flags] monitor
+  lutronctl [flags] query [output...]
+  lutronctl [flags] raw [-wait 2s] <line>...
+  lutronctl [flags] shell
+
+Outputs, keypads and buttons may be given as integration ids or, when
+a names file or the integration report is loaded, by name. Credentials
+are read from flags, LUTRON_ADDR, LUTRON_USER and LUTRON_PASS, or the
+config file:
+
+  {"addr": "192.168.1.5", "user": "lutron", "pass": "integration"}
+
+The shell command starts an interactive console. Events from the repeater
+are printed as they arrive, and every command sent is shown decoded, for
+example "Kitchen/Island → 45% over 2s". Lines starting with # or ? are
+sent as integration commands, with a name allowed in place of the
+integration id; other lines run the commands above. Tab completes
+commands, protocol types, names and ids.
+*/
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spearce/lutron"
+)
+
+type command struct {
+	args string
+	help string
+	run  func(conn *lutron.Conn, args []string) error
+}
+
+var commands = map[string]*command{
+	"level": {
+		args: "<output> [value] [-fade duration]",
+		help: "print or set the level of a dimmer or switch",
+		run:  level},
+	"press": {
+		args: "<keypad> <button>",
+		help: "press and release a keypad button",
+		run:  press},
+	"led": {
+		args: "<keypad> <button> <on|off|flash|rapid>",
+		help: "set the LED of an unprogrammed button",
+		run:  led},
+	"monitor": {
+		help: "print all events from the repeater",
+		run:  monitor},
+	"query": {
+		args: "[output...]",
+		help: "print levels, or refresh every known object",
+		run:  query},
+	"raw": {
+		args: "[-wait duration] <line>...",
+		help: "send integration commands and print replies",
+		run:  raw},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: lutronctl [flags] <command> [args]\n\ncommands:\n")
+	var names []string
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		c := commands[n]
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n           %s\n", n, c.args, c.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := flag.Arg(0)
+	cmd := commands[name]
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "lutronctl: unknown command %q\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	conn, err := cfg.dial()
+	if err != nil {
+		fatal(err)
+	}
+
+	err = cmd.run(conn, flag.Args()[1:])
+	conn.Close()
+	if err == errUsage {
+		fmt.Fprintf(os.Stderr, "usage: lutronctl %s %s\n", name, cmd.args)
+		os.Exit(2)
+	} else if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "lutronctl: %v\n", err)
+	os.Exit(1)
+}
+
+// Parse flags that may appear anywhere among the positional arguments,
+// such as "level 12 50 -fade 5s".
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return pos, nil
+		}
+		pos = append(pos, args[0])
+		args = args[1:]
+	}
+}
+
+// Returned by a command when its arguments are invalid.
+var errUsage = errors.New("invalid arguments")
@@ -0,0 +1,367 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chzyer/readline"
+	"github.com/spearce/lutron"
+)
+
+// Command types of the integration protocol, offered by tab completion.
+var protocolTypes = []string{
+	"AREA", "DETAILS", "DEVICE", "ERROR", "ETHERNET", "GROUP", "HELP",
+	"HVAC", "INTEGRATIONID", "MONITORING", "OUTPUT", "PROGRAMMING",
+	"RESET", "SHADEGRP", "SYSTEM", "SYSVAR", "TIMECLOCK",
+}
+
+// Commands that make no sense inside the shell.
+var notInShell = map[string]bool{"monitor": true, "shell": true}
+
+func init() {
+	// Registered here as shell dispatches through commands.
+	commands["shell"] = &command{
+		help: "interactive console showing live events",
+		run:  shell}
+}
+
+func shell(conn *lutron.Conn, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:            "lutron> ",
+		HistoryFile:       historyFile(),
+		HistorySearchFold: true,
+		AutoComplete:      &completer{conn},
+		InterruptPrompt:   "^C",
+		EOFPrompt:         "exit",
+	})
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+
+	notices := make(notices, 64)
+	conn.AddObserver(notices)
+	defer conn.RemoveObserver(notices)
+	events := make(chan lutron.Event)
+	sub := conn.SubscribeEvents(events, lutron.EventFilter{}, lutron.MonitorOptions{})
+	defer sub.Unsubscribe()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		out := rl.Stdout()
+		for {
+			select {
+			case e := <-events:
+				fmt.Fprintln(out, describe(conn, e))
+			case n := <-notices:
+				fmt.Fprintln(out, n.describe(conn))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	fmt.Fprintln(rl.Stdout(), `Type "help" for commands; ^D exits.`)
+	for {
+		line, err := rl.Readline()
+		if err == readline.ErrInterrupt {
+			continue
+		} else if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case line == "exit" || line == "quit":
+			return nil
+		case line == "help":
+			shellHelp(rl.Stderr())
+		case line[0] == '#' || line[0] == '?':
+			err = sendLine(conn, line)
+		default:
+			err = runLine(conn, line)
+		}
+		if err != nil {
+			fmt.Fprintf(rl.Stderr(), "error: %v\n", err)
+		}
+	}
+}
+
+func historyFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "lutronctl_history")
+}
+
+func shellHelp(w io.Writer) {
+	fmt.Fprintf(w, "  #TYPE,id,...  send an integration command, e.g. #OUTPUT,Kitchen/Island,1,45,2\n")
+	fmt.Fprintf(w, "  ?TYPE,id,...  send an integration query, e.g. ?OUTPUT,12,1\n")
+	for _, n := range commandNames() {
+		if !notInShell[n] {
+			fmt.Fprintf(w, "  %s %s\n", n, commands[n].args)
+		}
+	}
+	fmt.Fprintf(w, "  exit\n")
+}
+
+func commandNames() []string {
+	var names []string
+	for n := range commands {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run one of the lutronctl commands typed in the shell.
+func runLine(conn *lutron.Conn, line string) error {
+	args, _ := splitArgs(line)
+	cmd := commands[args[0]]
+	if cmd == nil || notInShell[args[0]] {
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	err := cmd.run(conn, args[1:])
+	if err == errUsage {
+		return fmt.Errorf("usage: %s %s", args[0], cmd.args)
+	}
+	return err
+}
+
+// Send an integration command or query, replacing a name in place of
+// the integration id with the id it refers to.
+func sendLine(conn *lutron.Conn, line string) error {
+	n := strings.Split(line, ",")
+	n[0] = strings.ToUpper(n[0])
+	if len(n) > 1 {
+		if _, err := strconv.Atoi(n[1]); err != nil {
+			ids, err := resolveName(conn, n[0][1:], n[1])
+			if err != nil {
+				return err
+			}
+			n = append(append(n[:1:1], ids...), n[2:]...)
+		}
+	}
+	return conn.Send(strings.Join(n, ","))
+}
+
+// Integration id fields for a named object. Button names expand to the
+// keypad id and the button's component number.
+func resolveName(conn *lutron.Conn, typ, name string) ([]string, error) {
+	switch typ {
+	case "OUTPUT":
+		d, err := conn.LookupDimmer(name)
+		if err != nil {
+			return nil, err
+		}
+		return []string{strconv.Itoa(d.Id())}, nil
+
+	case "DEVICE":
+		obj, err := conn.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		if b, ok := obj.(*lutron.KeypadButton); ok {
+			return []string{strconv.Itoa(b.Keypad().Id()), strconv.Itoa(int(b.Id()))}, nil
+		}
+		k, err := conn.LookupKeypad(name)
+		if err != nil {
+			return nil, err
+		}
+		return []string{strconv.Itoa(k.Id())}, nil
+	}
+	return nil, fmt.Errorf("names are not supported for %s", typ)
+}
+
+// Split a shell line into arguments. Arguments containing spaces may be
+// quoted with " or have their spaces escaped with \. Also returns the
+// offset in s at which the last, possibly empty, argument begins.
+func splitArgs(s string) (args []string, last int) {
+	var cur strings.Builder
+	in, quoted, escaped := false, false, false
+	start := func(i int) {
+		if !in {
+			in = true
+			last = i
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case escaped:
+			cur.WriteByte(ch)
+			escaped = false
+		case ch == '\\':
+			start(i)
+			escaped = true
+		case ch == '"':
+			start(i)
+			quoted = !quoted
+		case ch == ' ' && !quoted:
+			if in {
+				args = append(args, cur.String())
+				cur.Reset()
+				in = false
+			}
+		default:
+			start(i)
+			cur.WriteByte(ch)
+		}
+	}
+	if in {
+		args = append(args, cur.String())
+	} else {
+		last = len(s)
+	}
+	return args, last
+}
+
+// Tab completion of commands, protocol types, names and integration ids.
+type completer struct {
+	conn *lutron.Conn
+}
+
+func (c *completer) Do(line []rune, pos int) ([][]rune, int) {
+	s := string(line[:pos])
+	if strings.HasPrefix(s, "#") || strings.HasPrefix(s, "?") {
+		return c.protocol(s)
+	}
+
+	args, last := splitArgs(s)
+	raw, word := s[last:], ""
+	if last < len(s) {
+		word = args[len(args)-1]
+		args = args[:len(args)-1]
+	}
+
+	var candidates []string
+	if len(args) == 0 {
+		for _, n := range append(commandNames(), "exit", "help") {
+			if !notInShell[n] {
+				candidates = append(candidates, n)
+			}
+		}
+	} else {
+		candidates = append(c.conn.ListNames(), c.ids("")...)
+		if args[0] == "led" {
+			candidates = append(candidates, "on", "off", "flash", "rapid")
+		}
+	}
+
+	quoted := strings.HasPrefix(raw, `"`)
+	var r [][]rune
+	for _, cand := range candidates {
+		if !strings.HasPrefix(cand, word) {
+			continue
+		}
+		rest := cand[len(word):]
+		if quoted {
+			rest += `"`
+		} else {
+			rest = strings.Replace(rest, " ", `\ `, -1)
+		}
+		r = append(r, []rune(rest+" "))
+	}
+	return r, len([]rune(raw))
+}
+
+// Complete the type or integration id field of a protocol line.
+func (c *completer) protocol(s string) ([][]rune, int) {
+	n := strings.Split(s, ",")
+	word := n[len(n)-1]
+
+	var candidates []string
+	switch len(n) {
+	case 1:
+		word = word[1:]
+		candidates = protocolTypes
+	case 2:
+		typ := strings.ToUpper(n[0][1:])
+		for _, name := range c.conn.ListNames() {
+			if _, err := resolveName(c.conn, typ, name); err == nil {
+				candidates = append(candidates, name)
+			}
+		}
+		candidates = append(candidates, c.ids(typ)...)
+	}
+
+	var r [][]rune
+	for _, cand := range candidates {
+		if len(cand) >= len(word) && strings.EqualFold(cand[:len(word)], word) {
+			r = append(r, []rune(cand[len(word):]+","))
+		}
+	}
+	return r, len([]rune(word))
+}
+
+// Known integration ids of outputs and keypads, or both if typ is "".
+func (c *completer) ids(typ string) []string {
+	var r []string
+	if typ == "" || typ == "OUTPUT" {
+		for _, d := range c.conn.Dimmers() {
+			r = append(r, strconv.Itoa(d.Id()))
+		}
+	}
+	if typ == "" || typ == "DEVICE" {
+		for _, k := range c.conn.Keypads() {
+			r = append(r, strconv.Itoa(k.Id()))
+		}
+	}
+	return r
+}
+
+// Activity reported by the connection's observer callbacks, which may
+// not call back into the Conn; names are resolved when displayed.
+type notice struct {
+	at          time.Time
+	sent        string
+	reconnected bool
+}
+
+type notices chan notice
+
+func (n notices) add(v notice) {
+	select {
+	case n <- v:
+	default:
+	}
+}
+
+func (n notices) CommandSent(line string, queued time.Duration) {
+	n.add(notice{at: time.Now(), sent: line})
+}
+
+func (n notices) Reconnected() {
+	n.add(notice{at: time.Now(), reconnected: true})
+}
+
+func (notices) EventReceived(e lutron.Event)                                 {}
+func (notices) LevelAcknowledged(d *lutron.Dimmer, l uint8, t time.Duration) {}
+
+func (n *notice) describe(conn *lutron.Conn) string {
+	t := n.at.Format("15:04:05.000")
+	if n.reconnected {
+		return t + " reconnected to repeater"
+	}
+	return t + " > " + describeCommand(conn, n.sent)
+}
@@ -5,7 +5,10 @@
 
 package lutron
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // Any RadioRA2 compatible device.
 type Component struct {
@@ -23,18 +26,35 @@ func (d *Component) Id() int {
 
 // Sends a query of the form "?<command>,<id>,<rest>" to the repeater.
 // The repeater will reply in the future with "~<command>,<id>,...".
-func (d *Component) Query(rest string) {
-	d.send('?', rest)
+// Queries are queued behind commands sent by Execute. ErrQueueFull is
+// returned if the query cannot be queued.
+func (d *Component) Query(rest string) error {
+	return d.send('?', rest, priorityQuery)
 }
 
 // Sends a command of the form "#<command>,<id>,<rest>" to the repeater.
-func (d *Component) Execute(rest string) {
-	d.send('#', rest)
+// ErrQueueFull is returned if the command cannot be queued.
+func (d *Component) Execute(rest string) error {
+	return d.send('#', rest, priorityCommand)
 }
 
-func (d *Component) send(operation int, rest string) {
+func (d *Component) send(operation int, rest string, p priority) error {
+	return d.Conn.queue.push(d.request(operation, rest, p))
+}
+
+// Queue several commands at once. Either all commands are queued or,
+// if ErrQueueFull is returned, none are.
+func (d *Component) executeAll(rest ...string) error {
+	r := make([]request, len(rest))
+	for i, s := range rest {
+		r[i] = d.request('#', s, priorityCommand)
+	}
+	return d.Conn.queue.push(r...)
+}
+
+func (d *Component) request(operation int, rest string, p priority) request {
 	cmd := fmt.Sprintf("%c%s,%d,%s", operation, d.command, d.id, rest)
-	d.Conn.requests <- request{cmd: cmd}
+	return request{cmd: cmd, priority: p, queued: time.Now()}
 }
 
 type monitored interface {
@@ -0,0 +1,317 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package config reads the RadioRA2 integration report.
+
+The main repeater serves its programming database as DbXmlInfo.xml over
+HTTP. The database describes every area, output (lighting load, shade,
+fan or contact closure) and device (keypad, Pico remote, repeater) along
+with the integration ids needed to address them through package lutron.
+
+  db, err := config.Fetch("192.168.1.5")
+  for _, o := range db.Outputs {
+    fmt.Println(o.IntegrationID, o.Path())
+  }
+*/
+package config
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Name of the integration report on the main repeater's web server.
+const DatabaseFile = "DbXmlInfo.xml"
+
+// Contents of an integration report.
+type Database struct {
+	// Name of the project as entered in the RadioRA2 software.
+	Project string
+
+	// Top level areas. RadioRA2 wraps the entire project in a single
+	// root area, which contains the rooms of the house.
+	Areas []*Area
+
+	// Every output and device in the project, area by area; those of an
+	// area come before those of its sub-areas.
+	Outputs []*Output
+	Devices []*Device
+}
+
+// Room or other grouping of outputs and devices.
+type Area struct {
+	Name          string
+	IntegrationID int
+
+	Parent  *Area // nil for the root area.
+	Areas   []*Area
+	Outputs []*Output
+	Devices []*Device
+}
+
+// Kind of load driven by an output.
+type OutputType int
+
+const (
+	OutputUnknown OutputType = iota
+	OutputDimmer
+	OutputSwitch
+	OutputShade
+	OutputFan
+	OutputCCO
+)
+
+// Lighting load, shade, fan or contact closure output.
+type Output struct {
+	Name          string
+	IntegrationID int
+	Type          OutputType
+	RawType       string // OutputType attribute, e.g. "INC" or "NON_DIM".
+	Wattage       int
+	Area          *Area
+}
+
+// Keypad, Pico remote, main repeater or other device with buttons.
+type Device struct {
+	Name          string
+	IntegrationID int
+	Model         string // DeviceType attribute, e.g. "SEETOUCH_KEYPAD".
+	SerialNumber  string
+	Area          *Area
+	Buttons       []*Button
+}
+
+// Button on a device.
+type Button struct {
+	// Component number of the button. Matches the value accepted by
+	// lutron.Keypad.Button.
+	Number int
+
+	// Name assigned in the software ("Button 1") and text engraved
+	// on the button ("Goodnight"). Engraving may be empty.
+	Name      string
+	Engraving string
+
+	ButtonType string // e.g. "Toggle", "SingleAction", "MasterRaiseLower".
+	LedLogic   int
+	Actions    []*Action
+	Device     *Device
+}
+
+// Programming executed by a button. Toggle buttons have separate
+// actions for the on and off states.
+type Action struct {
+	Number      int
+	Assignments []*Assignment
+}
+
+// Level an output is set to by an action.
+type Assignment struct {
+	IntegrationID int
+	Type          int
+	Level         float64
+	Fade          time.Duration
+	Delay         time.Duration
+}
+
+// Separator between path components returned by Path().
+const PathSeparator = "/"
+
+// Names of the areas leading to this area, joined by "/", such as
+// "Upstairs/Master Bedroom". The root area is not included.
+func (a *Area) Path() string {
+	if a == nil || a.Parent == nil {
+		return ""
+	}
+	return join(a.Parent.Path(), a.Name)
+}
+
+// Name of the output qualified by its area, e.g. "Kitchen/Island Pendants".
+func (o *Output) Path() string {
+	return join(o.Area.Path(), o.Name)
+}
+
+// Name of the device qualified by its area, e.g. "Foyer/Front Door Keypad".
+func (d *Device) Path() string {
+	return join(d.Area.Path(), d.Name)
+}
+
+// Label of the button, its engraving if one was entered, else its name.
+func (b *Button) Label() string {
+	if b.Engraving != "" {
+		return b.Engraving
+	}
+	return b.Name
+}
+
+// Name of the button qualified by its device, for example
+// "Foyer/Front Door Keypad/Goodnight".
+func (b *Button) Path() string {
+	return join(b.Device.Path(), b.Label())
+}
+
+// True if the device is a hybrid keypad, which also drives a load
+// using the device's integration id.
+func (d *Device) IsHybrid() bool {
+	return strings.HasPrefix(d.Model, "HYBRID_")
+}
+
+func join(parent, name string) string {
+	name = strings.Replace(name, PathSeparator, " ", -1)
+	if parent == "" {
+		return name
+	}
+	return parent + PathSeparator + name
+}
+
+func (t OutputType) String() string {
+	switch t {
+	case OutputDimmer:
+		return "dimmer"
+	case OutputSwitch:
+		return "switch"
+	case OutputShade:
+		return "shade"
+	case OutputFan:
+		return "fan"
+	case OutputCCO:
+		return "cco"
+	}
+	return "unknown"
+}
+
+func outputType(s string) OutputType {
+	switch s {
+	case "NON_DIM", "NON_DIM_INC", "NON_DIM_ELV", "RELAY_LIGHTING":
+		return OutputSwitch
+	case "SYSTEM_SHADE", "MOTOR":
+		return OutputShade
+	case "CEILING_FAN_TYPE":
+		return OutputFan
+	case "CCO_PULSED", "CCO_MAINTAINED":
+		return OutputCCO
+	case "INC", "MLV", "ELV", "AUTO_DETECT", "FLUORESCENT_DB", "NEON",
+		"ZERO_TO_TEN", "ECO_SYSTEM_FLUORESCENT", "LED":
+		return OutputDimmer
+	}
+	return OutputUnknown
+}
+
+// Parse an integration report.
+func Parse(r io.Reader) (*Database, error) {
+	var p xmlProject
+	if err := xml.NewDecoder(r).Decode(&p); err != nil {
+		return nil, err
+	}
+	if len(p.Areas) == 0 {
+		return nil, errors.New("config: no areas in integration report")
+	}
+
+	db := &Database{Project: p.Name.Name}
+	for i := range p.Areas {
+		db.Areas = append(db.Areas, db.area(nil, &p.Areas[i]))
+	}
+	return db, nil
+}
+
+// Parse an integration report stored in a local file.
+func ParseFile(name string) (*Database, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Download and parse the integration report from the main repeater.
+func Fetch(addr string) (*Database, error) {
+	c := http.Client{Timeout: 30 * time.Second}
+	r, err := c.Get("http://" + net.JoinHostPort(addr, "80") + "/" + DatabaseFile)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("config: fetching %s: %s", DatabaseFile, r.Status)
+	}
+	return Parse(r.Body)
+}
+
+func (db *Database) area(parent *Area, x *xmlArea) *Area {
+	a := &Area{Name: x.Name, IntegrationID: x.IntegrationID, Parent: parent}
+	for _, xo := range x.Outputs {
+		o := &Output{
+			Name:          xo.Name,
+			IntegrationID: xo.IntegrationID,
+			Type:          outputType(xo.OutputType),
+			RawType:       xo.OutputType,
+			Wattage:       xo.Wattage,
+			Area:          a}
+		a.Outputs = append(a.Outputs, o)
+		db.Outputs = append(db.Outputs, o)
+	}
+	for i := range x.Devices {
+		db.device(a, &x.Devices[i])
+	}
+	for _, g := range x.Groups {
+		for i := range g.Devices {
+			db.device(a, &g.Devices[i])
+		}
+	}
+	for i := range x.Areas {
+		a.Areas = append(a.Areas, db.area(a, &x.Areas[i]))
+	}
+	return a
+}
+
+func (db *Database) device(a *Area, x *xmlDevice) {
+	d := &Device{
+		Name:          x.Name,
+		IntegrationID: x.IntegrationID,
+		Model:         x.DeviceType,
+		SerialNumber:  x.SerialNumber,
+		Area:          a}
+	for _, c := range x.Components {
+		if c.Type != "BUTTON" {
+			continue
+		}
+		b := &Button{
+			Number:     c.Number,
+			Name:       c.Button.Name,
+			Engraving:  c.Button.Engraving,
+			ButtonType: c.Button.ButtonType,
+			LedLogic:   c.Button.LedLogic,
+			Device:     d}
+		for _, xa := range c.Button.Actions {
+			act := &Action{Number: xa.Number}
+			for _, p := range xa.Assignments {
+				act.Assignments = append(act.Assignments, &Assignment{
+					IntegrationID: p.IntegrationID,
+					Type:          p.AssignmentType,
+					Level:         p.Level,
+					Fade:          seconds(p.FadeTime),
+					Delay:         seconds(p.DelayTime)})
+			}
+			b.Actions = append(b.Actions, act)
+		}
+		d.Buttons = append(d.Buttons, b)
+	}
+	a.Devices = append(a.Devices, d)
+	db.Devices = append(db.Devices, d)
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,239 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spearce/lutron"
+	"github.com/spearce/lutron/config"
+)
+
+func load(t *testing.T) *config.Database {
+	db, err := config.ParseFile("testdata/DbXmlInfo.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestAreas(t *testing.T) {
+	db := load(t)
+	if db.Project != "Sample House" {
+		t.Errorf("Project = %q", db.Project)
+	}
+	if len(db.Areas) != 1 {
+		t.Fatalf("%d root areas, want 1", len(db.Areas))
+	}
+	root := db.Areas[0]
+	if root.Path() != "" {
+		t.Errorf("root Path = %q, want empty", root.Path())
+	}
+
+	var names []string
+	for _, a := range root.Areas {
+		names = append(names, a.Name)
+	}
+	if got := strings.Join(names, ","); got != "Kitchen,Foyer,Upstairs" {
+		t.Errorf("rooms = %s", got)
+	}
+
+	bedroom := root.Areas[2].Areas[0]
+	if bedroom.Path() != "Upstairs/Master Bedroom" || bedroom.IntegrationID != 9 {
+		t.Errorf("bedroom = %q id %d", bedroom.Path(), bedroom.IntegrationID)
+	}
+	if bedroom.Parent != root.Areas[2] {
+		t.Errorf("bedroom Parent = %v", bedroom.Parent)
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	want := []struct {
+		path string
+		id   int
+		typ  config.OutputType
+		raw  string
+	}{
+		{"Kitchen/Island Pendants", 12, config.OutputDimmer, "INC"},
+		{"Kitchen/Cans", 13, config.OutputDimmer, "ELV"},
+		{"Kitchen/Disposal", 14, config.OutputSwitch, "NON_DIM"},
+		{"Foyer/Porch Light", 21, config.OutputSwitch, "NON_DIM"},
+		{"Upstairs/Garage Door", 40, config.OutputCCO, "CCO_PULSED"},
+		{"Upstairs/Master Bedroom/Sconces", 31, config.OutputDimmer, "MLV"},
+		{"Upstairs/Master Bedroom/Blackout Shade", 32, config.OutputShade, "SYSTEM_SHADE"},
+		{"Upstairs/Master Bedroom/Ceiling Fan", 33, config.OutputFan, "CEILING_FAN_TYPE"},
+	}
+
+	db := load(t)
+	if len(db.Outputs) != len(want) {
+		t.Fatalf("%d outputs, want %d", len(db.Outputs), len(want))
+	}
+	for i, w := range want {
+		o := db.Outputs[i]
+		if o.Path() != w.path || o.IntegrationID != w.id || o.Type != w.typ || o.RawType != w.raw {
+			t.Errorf("output %d = %q id %d %v %s, want %q id %d %v %s",
+				i, o.Path(), o.IntegrationID, o.Type, o.RawType,
+				w.path, w.id, w.typ, w.raw)
+		}
+	}
+}
+
+func TestDevices(t *testing.T) {
+	want := []struct {
+		path    string
+		id      int
+		model   string
+		hybrid  bool
+		buttons string
+	}{
+		{"Main Repeater", 1, "MAIN_REPEATER", false, "Main Repeater/All Off"},
+		{"Kitchen/Island Keypad", 4, "SEETOUCH_KEYPAD", false,
+			"Kitchen/Island Keypad/Cooking,Kitchen/Island Keypad/Button 5"},
+		{"Foyer/Front Door Keypad", 6, "HYBRID_SEETOUCH_KEYPAD", true,
+			"Foyer/Front Door Keypad/Welcome,Foyer/Front Door Keypad/Goodnight"},
+		{"Upstairs/Master Bedroom/Bedside Pico", 30, "PICO_KEYPAD", false,
+			"Upstairs/Master Bedroom/Bedside Pico/Button 1,Upstairs/Master Bedroom/Bedside Pico/Button 3"},
+	}
+
+	db := load(t)
+	if len(db.Devices) != len(want) {
+		t.Fatalf("%d devices, want %d", len(db.Devices), len(want))
+	}
+	for i, w := range want {
+		d := db.Devices[i]
+		if d.Path() != w.path || d.IntegrationID != w.id || d.Model != w.model || d.IsHybrid() != w.hybrid {
+			t.Errorf("device %d = %q id %d %s hybrid %v", i, d.Path(), d.IntegrationID, d.Model, d.IsHybrid())
+		}
+		var buttons []string
+		for _, b := range d.Buttons {
+			if b.Device != d {
+				t.Errorf("%s: Device not set", b.Path())
+			}
+			buttons = append(buttons, b.Path())
+		}
+		if got := strings.Join(buttons, ","); got != w.buttons {
+			t.Errorf("%s buttons = %s, want %s", w.path, got, w.buttons)
+		}
+	}
+
+	pico := db.Devices[3]
+	if pico.Buttons[0].Number != 2 || pico.Buttons[1].Number != 4 {
+		t.Errorf("pico button numbers = %d, %d", pico.Buttons[0].Number, pico.Buttons[1].Number)
+	}
+}
+
+func TestActions(t *testing.T) {
+	db := load(t)
+
+	cooking := db.Devices[1].Buttons[0]
+	if cooking.ButtonType != "Toggle" || cooking.LedLogic != 1 || len(cooking.Actions) != 2 {
+		t.Fatalf("Cooking = %s led %d, %d actions", cooking.ButtonType, cooking.LedLogic, len(cooking.Actions))
+	}
+	on, off := cooking.Actions[0], cooking.Actions[1]
+	if on.Number != 1 || off.Number != 2 {
+		t.Errorf("action numbers = %d, %d", on.Number, off.Number)
+	}
+	if len(on.Assignments) != 2 || on.Assignments[1].IntegrationID != 13 || on.Assignments[1].Level != 75 {
+		t.Errorf("on assignments = %+v", on.Assignments)
+	}
+	if off.Assignments[0].Level != 0 || off.Assignments[0].Fade != 2*time.Second {
+		t.Errorf("off assignment = %+v", off.Assignments[0])
+	}
+
+	goodnight := db.Devices[2].Buttons[1]
+	if len(goodnight.Actions) != 1 || len(goodnight.Actions[0].Assignments) != 4 {
+		t.Fatalf("Goodnight actions = %+v", goodnight.Actions)
+	}
+	porch := goodnight.Actions[0].Assignments[3]
+	if porch.IntegrationID != 21 || porch.Fade != 0 || porch.Delay != time.Minute || porch.Type != 2 {
+		t.Errorf("porch assignment = %+v", porch)
+	}
+
+	if n := len(db.Devices[1].Buttons[1].Actions); n != 0 {
+		t.Errorf("unprogrammed button has %d actions", n)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"<Project>",
+		`<Project><ProjectName ProjectName="x" /><Areas /></Project>`,
+	} {
+		if _, err := config.Parse(strings.NewReader(s)); err == nil {
+			t.Errorf("Parse(%q) succeeded", s)
+		}
+	}
+}
+
+// Transport accepting commands and never replying.
+type silent struct {
+	closed chan struct{}
+}
+
+func (s *silent) ReadLine() (string, error) {
+	<-s.closed
+	return "", io.EOF
+}
+
+func (s *silent) WriteLine(string) error { return nil }
+
+func (s *silent) Close() error {
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	return nil
+}
+
+func TestAddDatabase(t *testing.T) {
+	conn, err := lutron.NewConn(&silent{make(chan struct{})}, lutron.WithCommandRate(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.AddDatabase(load(t))
+
+	if d, err := conn.LookupDimmer("Kitchen/Island Pendants"); err != nil || d.Id() != 12 {
+		t.Errorf("Island Pendants = %v, %v", d, err)
+	}
+	if obj, err := conn.Lookup("Foyer/Porch Light"); err != nil {
+		t.Error(err)
+	} else if _, ok := obj.(*lutron.Switch); !ok {
+		t.Errorf("Porch Light is %T, want *lutron.Switch", obj)
+	}
+	if obj, err := conn.Lookup("Upstairs/Garage Door"); err != nil {
+		t.Error(err)
+	} else if _, ok := obj.(*lutron.Switch); !ok {
+		t.Errorf("Garage Door is %T, want *lutron.Switch", obj)
+	}
+	if d, err := conn.LookupDimmer("Upstairs/Master Bedroom/Blackout Shade"); err != nil || d.Id() != 32 {
+		t.Errorf("Blackout Shade = %v, %v", d, err)
+	}
+
+	if obj, err := conn.Lookup("Foyer/Front Door Keypad"); err != nil {
+		t.Error(err)
+	} else if _, ok := obj.(*lutron.HybridKeypad); !ok {
+		t.Errorf("Front Door Keypad is %T, want *lutron.HybridKeypad", obj)
+	}
+	if k, err := conn.LookupKeypad("Kitchen/Island Keypad"); err != nil || k.Id() != 4 {
+		t.Errorf("Island Keypad = %v, %v", k, err)
+	}
+	if _, err := conn.LookupButton("Foyer/Front Door Keypad/Goodnight"); err != nil {
+		t.Error(err)
+	}
+	if _, err := conn.LookupButton("Upstairs/Master Bedroom/Bedside Pico/Button 3"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := conn.Lookup("Kitchen/No Such Light"); err == nil {
+		t.Error("Lookup of unknown name succeeded")
+	}
+}
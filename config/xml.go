@@ -0,0 +1,75 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package config
+
+// Raw structure of DbXmlInfo.xml as served by the main repeater.
+// Only the elements and attributes used by this package are declared;
+// encoding/xml ignores everything else.
+
+type xmlProject struct {
+	Name  xmlProjectName `xml:"ProjectName"`
+	Areas []xmlArea      `xml:"Areas>Area"`
+}
+
+type xmlProjectName struct {
+	Name string `xml:"ProjectName,attr"`
+}
+
+type xmlArea struct {
+	Name          string           `xml:"Name,attr"`
+	IntegrationID int              `xml:"IntegrationID,attr"`
+	Areas         []xmlArea        `xml:"Areas>Area"`
+	Groups        []xmlDeviceGroup `xml:"DeviceGroups>DeviceGroup"`
+	Devices       []xmlDevice      `xml:"DeviceGroups>Device"`
+	Outputs       []xmlOutput      `xml:"Outputs>Output"`
+}
+
+type xmlDeviceGroup struct {
+	Name    string      `xml:"Name,attr"`
+	Devices []xmlDevice `xml:"Devices>Device"`
+}
+
+type xmlDevice struct {
+	Name          string         `xml:"Name,attr"`
+	IntegrationID int            `xml:"IntegrationID,attr"`
+	DeviceType    string         `xml:"DeviceType,attr"`
+	SerialNumber  string         `xml:"SerialNumber,attr"`
+	Components    []xmlComponent `xml:"Components>Component"`
+}
+
+type xmlComponent struct {
+	Number int       `xml:"ComponentNumber,attr"`
+	Type   string    `xml:"ComponentType,attr"`
+	Button xmlButton `xml:"Button"`
+}
+
+type xmlButton struct {
+	Name       string      `xml:"Name,attr"`
+	Engraving  string      `xml:"Engraving,attr"`
+	ButtonType string      `xml:"ButtonType,attr"`
+	LedLogic   int         `xml:"LedLogic,attr"`
+	Actions    []xmlAction `xml:"Actions>Action"`
+}
+
+type xmlAction struct {
+	Number      int                   `xml:"ActionNumber,attr"`
+	Assignments []xmlPresetAssignment `xml:"Presets>Preset>PresetAssignments>PresetAssignment"`
+}
+
+type xmlPresetAssignment struct {
+	IntegrationID  int     `xml:"IntegrationID,attr"`
+	AssignmentType int     `xml:"AssignmentType,attr"`
+	Level          float64 `xml:"Level,attr"`
+	FadeTime       float64 `xml:"FadeTime,attr"`
+	DelayTime      float64 `xml:"DelayTime,attr"`
+}
+
+type xmlOutput struct {
+	Name          string `xml:"Name,attr"`
+	IntegrationID int    `xml:"IntegrationID,attr"`
+	OutputType    string `xml:"OutputType,attr"`
+	Wattage       int    `xml:"Wattage,attr"`
+}
@@ -0,0 +1,68 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import "github.com/spearce/lutron/config"
+
+// Download the integration report (DbXmlInfo.xml) from the main repeater
+// and register every output, device and button by name. See AddDatabase.
+func (c *Conn) LoadDatabase() (*config.Database, error) {
+	db, err := config.Fetch(c.addr)
+	if err != nil {
+		return nil, err
+	}
+	c.AddDatabase(db)
+	return db, nil
+}
+
+// Register outputs, devices and buttons described by an integration
+// report under their qualified names, for example "Kitchen/Island Pendants"
+// or "Foyer/Front Door Keypad/Goodnight". Objects are registered as:
+//
+//   dimmer, shade, fan outputs   *Dimmer
+//   switch, CCO outputs          *Switch
+//   hybrid keypads               *HybridKeypad
+//   other devices with buttons   *Keypad
+//   buttons                      *KeypadButton
+//
+// Shades and fans accept levels through the same protocol as dimmers.
+// Registered objects can be found with Lookup. The outputs each button
+// is programmed to set are used to attribute level changes to button
+// presses; see Source.
+func (c *Conn) AddDatabase(db *config.Database) {
+	for _, o := range db.Outputs {
+		switch o.Type {
+		case config.OutputSwitch, config.OutputCCO:
+			c.register(o.Path(), c.Switch(o.IntegrationID))
+		default:
+			c.register(o.Path(), c.Dimmer(o.IntegrationID))
+		}
+	}
+
+	for _, d := range db.Devices {
+		if len(d.Buttons) == 0 {
+			continue
+		}
+
+		var k *Keypad
+		if d.IsHybrid() {
+			h := c.HybridKeypad(d.IntegrationID)
+			c.register(d.Path(), h)
+			k = h.Keypad
+		} else {
+			k = c.Keypad(d.IntegrationID)
+			c.register(d.Path(), k)
+		}
+		for _, b := range d.Buttons {
+			c.register(b.Path(), k.Button(uint8(b.Number)))
+			for _, a := range b.Actions {
+				for _, as := range a.Assignments {
+					c.addControl(as.IntegrationID, d.IntegrationID, uint8(b.Number))
+				}
+			}
+		}
+	}
+}
@@ -7,7 +7,6 @@ package lutron
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,6 +15,10 @@ import (
 
 const (
 	DefaultFade = 2 * time.Second
+
+	// Longest fade accepted by the main repeater; longer fades are
+	// shortened to MaxFade.
+	MaxFade = 4 * time.Hour
 )
 
 // Maestro style dimmer (RRD-6CL, RRD-6NA, RRD-10ND, ...).
@@ -28,10 +31,12 @@ type Dimmer struct {
 	mu       sync.Mutex
 	level    uint8
 	valid    bool
+	stale    bool // level loaded from the state file.
 	querying bool
+	lastOn   uint8 // Last level above 0, for Toggle.
 	fade     *time.Duration
 	readers  []chan uint8
-	monitors []chan LevelChange
+	monitors []*Subscription
 	pending  []adjustDimmer
 }
 
@@ -41,12 +46,62 @@ type LevelChange struct {
 
 	// New level, 0 (off) to 100 (fully on).
 	Level uint8
+
+	// Level was loaded from the state file and has not yet been
+	// confirmed by the main repeater. See WithStateFile.
+	Stale bool
+
+	// What caused the change, as far as the connection can tell.
+	Source Source
+}
+
+// Origin of a LevelChange, inferred by correlating the level with
+// commands sent through the connection and recent events of the keypad
+// buttons programmed to set the dimmer. Buttons are only known from an
+// integration database (see AddDatabase); without one, changes caused
+// by buttons are SourceUnknown.
+type Source uint8
+
+const (
+	// Not explained by this connection: a dimmer's own controls, the
+	// repeater's timeclock, or another integration client.
+	SourceUnknown Source = iota
+
+	// Acknowledges a level set through this connection, directly or
+	// by pressing a button programmed to set the dimmer with
+	// KeypadButton.Press.
+	SourceCommand
+
+	// Followed a press or release by a person of a keypad button
+	// programmed to set the dimmer.
+	SourceKeypad
+
+	// First level known for the dimmer, reported by a query or sent
+	// when subscribing, rather than a change.
+	SourceQuery
+)
+
+// Time after a button event during which level changes of the outputs
+// it is programmed to set are attributed to the button.
+const buttonWindow = 3 * time.Second
+
+func (s Source) String() string {
+	switch s {
+	case SourceCommand:
+		return "command"
+	case SourceKeypad:
+		return "keypad"
+	case SourceQuery:
+		return "query"
+	}
+	return "unknown"
 }
 
 type adjustDimmer struct {
-	level uint8
-	fade  time.Duration
-	reply chan uint8
+	level     uint8
+	fade      time.Duration
+	reply     chan uint8
+	requested time.Time
 }
 
 // Raise the dimmer to on (100%), sending the new level when acknowledged.
@@ -67,10 +122,27 @@ func (d *Dimmer) SetLevel(level uint8) chan uint8 {
 
 // Set the level (0-100) over the fade duration, sending the new level
 // on the returned channel when the main repeater has acknowledged it.
+// If the command cannot be queued (see ErrQueueFull) the channel is
+// closed without sending a level.
 func (d *Dimmer) Fade(level uint8, fade time.Duration) chan uint8 {
-	c := make(chan uint8, 1)
+	c, err := d.fadeLevel(level, fade)
+	if err != nil {
+		c = make(chan uint8)
+		close(c)
+	}
+	return c
+}
+
+// Fade, returning ErrQueueFull rather than a closed channel.
+func (d *Dimmer) fadeLevel(level uint8, fade time.Duration) (chan uint8, error) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
+	return d.fadeLocked(level, fade)
+}
+
+// Fade with d.mu held.
+func (d *Dimmer) fadeLocked(level uint8, fade time.Duration) (chan uint8, error) {
+	c := make(chan uint8, 1)
 
 	// Repeater won't acknowledge the level change if the dimmer
 	// is already at the requested level. Arrange to only send a
@@ -79,16 +151,102 @@ func (d *Dimmer) Fade(level uint8, fade time.Duration) chan uint8 {
 	if d.valid && d.level == level && len(d.pending) == 0 {
 		c <- level
 		close(c)
-		return c
+		return c, nil
 	}
 
-	p := adjustDimmer{level: level, fade: fade, reply: c}
+	p := adjustDimmer{level: level, fade: fade, reply: c, requested: time.Now()}
 	if !d.valid {
 		d.query()
 	} else if len(d.pending) == 0 {
-		d.setLevel(p)
+		if err := d.setLevel(p); err != nil {
+			return nil, err
+		}
 	}
 	d.pending = append(d.pending, p)
+	return c, nil
+}
+
+// Turn the dimmer off if it is on, or back on to the last level above 0
+// it was observed at (100% if none), using the default fade. A fade in
+// progress counts as its target level. The new level is sent on the
+// returned channel when acknowledged, as for Fade.
+func (d *Dimmer) Toggle() chan uint8 {
+	return d.adjust(func(level uint8) uint8 {
+		if level > 0 {
+			return 0
+		}
+		if d.lastOn > 0 {
+			return d.lastOn
+		}
+		return 100
+	})
+}
+
+// Step through preset levels: if the dimmer is at (or fading to) one of
+// levels the next in the list is set, wrapping around to the first;
+// otherwise the first is set. Uses the default fade, and sends the new
+// level on the returned channel when acknowledged, as for Fade.
+//
+// Calling Cycle(25, 50, 100, 0) from a button handler steps a room
+// through low, medium, full and off.
+func (d *Dimmer) Cycle(levels ...uint8) chan uint8 {
+	if len(levels) == 0 {
+		c := make(chan uint8)
+		close(c)
+		return c
+	}
+	return d.adjust(func(level uint8) uint8 {
+		for i, l := range levels {
+			if l == level {
+				return levels[(i+1)%len(levels)]
+			}
+		}
+		return levels[0]
+	})
+}
+
+// Fade to a level computed from the current target level, querying the
+// repeater first if the level is not known. next is called with d.mu
+// held.
+func (d *Dimmer) adjust(next func(level uint8) uint8) chan uint8 {
+	fade := d.DefaultFade()
+
+	d.mu.Lock()
+	if n := len(d.pending); n > 0 || d.valid {
+		level := d.level
+		if n > 0 {
+			level = d.pending[n-1].level
+		}
+		c, err := d.fadeLocked(next(level), fade)
+		d.mu.Unlock()
+		if err != nil {
+			c = make(chan uint8)
+			close(c)
+		}
+		return c
+	}
+	d.mu.Unlock()
+
+	c := make(chan uint8, 1)
+	go func() {
+		defer close(c)
+		if _, ok := <-d.ReadLevel(); !ok {
+			return
+		}
+		d.mu.Lock()
+		level := d.level
+		if n := len(d.pending); n > 0 {
+			level = d.pending[n-1].level
+		}
+		r, err := d.fadeLocked(next(level), fade)
+		d.mu.Unlock()
+		if err != nil {
+			return
+		}
+		if l, ok := <-r; ok {
+			c <- l
+		}
+	}()
 	return c
 }
 
@@ -110,28 +268,59 @@ func (d *Dimmer) SetDefaultFade(fade time.Duration) {
 }
 
 // Creates a new channel receiving updates when the dimmer is adjusted.
+// Updates are delivered as by AddMonitor. Use AddMonitor or Subscribe
+// to be able to stop them.
 func (d *Dimmer) Monitor() chan LevelChange {
 	c := make(chan LevelChange, 5)
 	d.AddMonitor(c)
 	return c
 }
 
-// Adds a channel to receive updates when the dimmer is adjusted.
-func (d *Dimmer) AddMonitor(c chan LevelChange) {
+// Adds a channel to receive updates when the dimmer is adjusted. Every
+// update is delivered; if c is not received from, processing of events
+// from the main repeater stalls once the subscription's buffer fills,
+// as with the Block overflow policy. Use Subscribe for non-blocking
+// delivery.
+func (d *Dimmer) AddMonitor(c chan LevelChange) *Subscription {
+	return d.Subscribe(c, blockingMonitor)
+}
+
+// Adds a channel to receive updates when the dimmer is adjusted, with
+// the buffering and overflow behavior described by o. The current level
+// is sent first, if known.
+func (d *Dimmer) Subscribe(c chan LevelChange, o MonitorOptions) *Subscription {
+	s := levelSubscription(c, o)
+	s.remove = d.detach
+	d.attach(s)
+	return s
+}
+
+func (d *Dimmer) attach(s *Subscription) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	d.monitors = append(d.monitors, c)
+	d.monitors = append(d.monitors, s)
 	if d.valid {
-		c <- LevelChange{d, d.level}
+		s.push(LevelChange{Dimmer: d, Level: d.level, Source: SourceQuery})
+	} else if d.stale {
+		// Level will be confirmed by the background refresh.
+		s.push(LevelChange{Dimmer: d, Level: d.level, Stale: true, Source: SourceQuery})
 	} else {
 		d.query()
 	}
 }
 
+func (d *Dimmer) detach(s *Subscription) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.monitors = removeSubscription(d.monitors, s)
+}
+
 // Get the level of the dimmer and send it once on the returned channel.
 // If the dimmer's level has not yet been observed it will be queried
 // and the value will be sent after the main repeater has replied.
+// A stale level loaded from the state file is sent immediately; use
+// CachedLevel() to distinguish stale levels.
 func (d *Dimmer) Level() chan uint8 {
 	return d.readLevel(true)
 }
@@ -148,7 +337,7 @@ func (d *Dimmer) readLevel(cached bool) chan uint8 {
 	defer d.mu.Unlock()
 
 	w := make(chan uint8, 1)
-	if cached && d.valid {
+	if cached && (d.valid || d.stale) {
 		w <- d.level
 		close(w)
 	} else {
@@ -158,14 +347,19 @@ func (d *Dimmer) readLevel(cached bool) chan uint8 {
 	return w
 }
 
-func (d *Dimmer) setLevel(p adjustDimmer) {
-	d.Execute(fmt.Sprintf("1,%d,%s", p.level, formatFade(p.fade)))
+func (d *Dimmer) setLevel(p adjustDimmer) error {
+	r := d.request('#', fmt.Sprintf("1,%d,%s", p.level, formatFade(p.fade)), priorityCommand)
+	r.awaited = true
+	return d.Conn.queue.push(r)
 }
 
 func (d *Dimmer) query() {
+	d.queryAt(priorityQuery)
+}
+
+func (d *Dimmer) queryAt(p priority) {
 	if !d.querying {
-		d.querying = true
-		d.Query("1")
+		d.querying = d.send('?', "1", p) == nil
 	}
 }
 
@@ -188,7 +382,7 @@ func (d *Dimmer) handleEvent(event string) error {
 		break
 
 	default:
-		log.Printf("dimmer %d ignoring %s", d.Id, event)
+		d.Conn.log.Debug("lutron dimmer ignoring event", "id", d.id, "args", event)
 	}
 	return nil
 }
@@ -204,17 +398,28 @@ func (d *Dimmer) handleLevel(level uint8) {
 	d.readers = nil
 	d.querying = false
 
+	if level > 0 {
+		d.lastOn = level
+	}
 	if !d.valid || d.level != level {
-		for _, c := range d.monitors {
-			c <- LevelChange{d, level}
+		src := d.source(level)
+		for _, s := range d.monitors {
+			s.push(LevelChange{Dimmer: d, Level: level, Source: src})
 		}
 		d.level = level
 		d.valid = true
 	}
+	d.stale = false
 
 	next := len(d.pending)
 	for i, p := range d.pending {
 		if p.level == level {
+			latency := time.Since(p.requested)
+			d.Conn.log.Debug("lutron level acknowledged", "id", d.id,
+				"level", level, "latency", latency)
+			d.Conn.observe(func(o Observer) {
+				o.LevelAcknowledged(d, level, latency)
+			})
 			p.reply <- level
 			close(p.reply)
 		} else {
@@ -224,12 +429,36 @@ func (d *Dimmer) handleLevel(level uint8) {
 	}
 	if next < len(d.pending) {
 		d.pending = d.pending[next:]
-		d.setLevel(d.pending[0])
+		if err := d.setLevel(d.pending[0]); err != nil {
+			for _, p := range d.pending {
+				close(p.reply)
+			}
+			d.pending = nil
+		}
 	} else {
 		d.pending = nil
 	}
 }
 
+// Classify a change to level. d.mu must be held.
+func (d *Dimmer) source(level uint8) Source {
+	if !d.valid {
+		return SourceQuery
+	}
+	for _, p := range d.pending {
+		if p.level == level {
+			return SourceCommand
+		}
+	}
+	if ours, ok := d.Conn.pressedFor(d.id); ok {
+		if ours {
+			return SourceCommand
+		}
+		return SourceKeypad
+	}
+	return SourceUnknown
+}
+
 func parseDimmerLevel(s string) (int, error) {
 	i := strings.Index(s, ".")
 	if i >= 0 {
@@ -239,7 +468,15 @@ func parseDimmerLevel(s string) (int, error) {
 }
 
 func formatFade(fade time.Duration) string {
-	if fade.Minutes() >= 1 {
+	if fade > MaxFade {
+		fade = MaxFade
+	}
+	if fade.Hours() >= 1 {
+		hh := int(fade.Hours())
+		mm := int(fade.Minutes()) - hh*60
+		ss := int(fade.Seconds()) - hh*3600 - mm*60
+		return fmt.Sprintf("%d:%02d:%02d", hh, mm, ss)
+	} else if fade.Minutes() >= 1 {
 		mm := int(fade.Minutes())
 		ss := int(fade.Seconds() - float64(mm*60))
 		return fmt.Sprintf("%02d:%02d", mm, ss)
@@ -250,6 +487,30 @@ func formatFade(fade time.Duration) string {
 	}
 }
 
+// Parse a fade or delay time as written in integration commands:
+// "SS.ss", "MM:SS" or "HH:MM:SS", where seconds may have a fraction.
+func ParseFade(s string) (time.Duration, error) {
+	n := strings.Split(s, ":")
+	if len(n) > 3 {
+		return 0, fmt.Errorf("lutron: invalid fade %q", s)
+	}
+	sec, err := strconv.ParseFloat(n[len(n)-1], 64)
+	if err != nil || sec < 0 {
+		return 0, fmt.Errorf("lutron: invalid fade %q", s)
+	}
+	fade := time.Duration(sec * float64(time.Second))
+	unit := time.Minute
+	for i := len(n) - 2; i >= 0; i-- {
+		v, err := strconv.Atoi(n[i])
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("lutron: invalid fade %q", s)
+		}
+		fade += time.Duration(v) * unit
+		unit *= 60
+	}
+	return fade, nil
+}
+
 func (d *Dimmer) reconnect() {
 	d.mu.Lock()
 	defer d.mu.Unlock()
@@ -261,7 +522,6 @@ func (d *Dimmer) reconnect() {
 	d.pending = nil
 
 	if d.readers != nil || d.monitors != nil {
-		d.querying = true
-		d.Query("1")
+		d.querying = d.Query("1") == nil
 	}
 }
@@ -0,0 +1,270 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reported for a member of a group whose level could not be read, or
+// whose command could not be queued after reading it, so no reply will
+// arrive.
+var ErrNoReply = errors.New("lutron: no reply from main repeater")
+
+// Collection of dimmers adjusted together, such as every zone on a
+// floor. Commands are sent to every member; the returned PendingLevels
+// waits for all acknowledgements and reports members that failed.
+type DimmerGroup struct {
+	members []*Dimmer
+}
+
+// Create a group of dimmers.
+func NewDimmerGroup(dimmers ...*Dimmer) *DimmerGroup {
+	return &DimmerGroup{dimmers}
+}
+
+// Dimmers in the group.
+func (g *DimmerGroup) Members() []*Dimmer {
+	return append([]*Dimmer(nil), g.members...)
+}
+
+// Set every member to level using each dimmer's default fade.
+func (g *DimmerGroup) SetLevel(level uint8) *PendingLevels {
+	p := &PendingLevels{}
+	for _, d := range g.members {
+		p.add(d, d.SetLevel(level), ErrQueueFull)
+	}
+	return p
+}
+
+// Set every member to level over fade.
+func (g *DimmerGroup) Fade(level uint8, fade time.Duration) *PendingLevels {
+	p := &PendingLevels{}
+	for _, d := range g.members {
+		p.add(d, d.Fade(level, fade), ErrQueueFull)
+	}
+	return p
+}
+
+// Make every member brighter (percent > 0) or dimmer (percent < 0)
+// relative to its current level, using each dimmer's default fade:
+// Scale(20) raises a member at 50% to 60%. Levels are limited to
+// 1-100%, so members are not turned off, and members that are off are
+// left off. Unknown levels are queried first.
+func (g *DimmerGroup) Scale(percent int) *PendingLevels {
+	p := &PendingLevels{}
+	for _, d := range g.members {
+		p.add(d, d.adjust(func(level uint8) uint8 {
+			return scale(level, percent)
+		}), ErrNoReply)
+	}
+	return p
+}
+
+// Level changed by percent of itself, rounded half away from zero and
+// limited to 1-100%. A level of 0 is unchanged.
+func scale(level uint8, percent int) uint8 {
+	if level == 0 {
+		return 0
+	}
+	l := int(level) + (int(level)*percent+50*sign(percent))/100
+	if l < 1 {
+		l = 1
+	} else if l > 100 {
+		l = 100
+	}
+	return uint8(l)
+}
+
+func sign(v int) int {
+	if v < 0 {
+		return -1
+	}
+	return 1
+}
+
+// Get the average level of the members, querying levels that are not
+// known and waiting until ctx is done. A *DimmerGroupError lists the
+// members that did not reply.
+func (g *DimmerGroup) Level(ctx context.Context) (uint8, error) {
+	p := &PendingLevels{}
+	for _, d := range g.members {
+		p.add(d, d.Level(), ErrNoReply)
+	}
+	levels, err := p.wait(ctx)
+	if err != nil || len(levels) == 0 {
+		return 0, err
+	}
+	sum := 0
+	for _, l := range levels {
+		sum += int(l)
+	}
+	return uint8((sum + len(levels)/2) / len(levels)), nil
+}
+
+// State of a group sent to monitors when it changes.
+type DimmerGroupChange struct {
+	Group *DimmerGroup
+
+	// Number of members above 0.
+	On int
+
+	// At least one member, or every member, is above 0.
+	AnyOn bool
+	AllOn bool
+}
+
+// Creates a new channel receiving a DimmerGroupChange when AnyOn or
+// AllOn changes. The first change is sent once the levels of all
+// members are known.
+func (g *DimmerGroup) Monitor() chan DimmerGroupChange {
+	c := make(chan DimmerGroupChange, 5)
+	g.Subscribe(c, MonitorOptions{})
+	return c
+}
+
+// Adds a channel to receive group changes as described for Monitor,
+// with the buffering and overflow behavior described by o.
+func (g *DimmerGroup) Subscribe(c chan DimmerGroupChange, o MonitorOptions) *Subscription {
+	out := newSubscription(o,
+		func(interface{}) interface{} { return g },
+		func(e interface{}, done chan struct{}) bool {
+			select {
+			case c <- e.(DimmerGroupChange):
+				return true
+			case <-done:
+				return false
+			}
+		})
+
+	var mu sync.Mutex
+	levels := make(map[*Dimmer]uint8)
+	distinct := make(map[*Dimmer]bool)
+	for _, d := range g.members {
+		distinct[d] = true
+	}
+	var last *DimmerGroupChange
+
+	update := func(e interface{}, done chan struct{}) bool {
+		lc := e.(LevelChange)
+		mu.Lock()
+		defer mu.Unlock()
+
+		levels[lc.Dimmer] = lc.Level
+		if len(levels) < len(distinct) {
+			return true
+		}
+		ch := DimmerGroupChange{Group: g}
+		for _, l := range levels {
+			if l > 0 {
+				ch.On++
+			}
+		}
+		ch.AnyOn = ch.On > 0
+		ch.AllOn = ch.On == len(levels)
+		if last == nil || last.AnyOn != ch.AnyOn || last.AllOn != ch.AllOn {
+			last = &ch
+			out.push(ch)
+		}
+		return true
+	}
+
+	var members []*Subscription
+	for d := range distinct {
+		s := newSubscription(MonitorOptions{},
+			func(e interface{}) interface{} { return e.(LevelChange).Dimmer },
+			update)
+		s.remove = d.detach
+		d.attach(s)
+		members = append(members, s)
+	}
+	out.remove = func(*Subscription) {
+		for _, s := range members {
+			s.Unsubscribe()
+		}
+	}
+	return out
+}
+
+// Replies from the members of a group after a command.
+type PendingLevels struct {
+	dimmers []*Dimmer
+	ch      []chan uint8
+	closed  []error // Reported if ch is closed without a reply.
+}
+
+func (p *PendingLevels) add(d *Dimmer, c chan uint8, closed error) {
+	p.dimmers = append(p.dimmers, d)
+	p.ch = append(p.ch, c)
+	p.closed = append(p.closed, closed)
+}
+
+// Wait for every member to be acknowledged by the main repeater, or
+// until ctx is done. A *DimmerGroupError lists the members that failed.
+func (p *PendingLevels) Wait(ctx context.Context) error {
+	_, err := p.wait(ctx)
+	return err
+}
+
+func (p *PendingLevels) wait(ctx context.Context) ([]uint8, error) {
+	var levels []uint8
+	e := &DimmerGroupError{}
+	for i, c := range p.ch {
+		var (
+			level uint8
+			ok    bool
+		)
+		select {
+		case level, ok = <-c:
+		case <-ctx.Done():
+			// Deadline passed; collect replies already received.
+			select {
+			case level, ok = <-c:
+			default:
+				e.Members = append(e.Members, MemberError{p.dimmers[i], ctx.Err()})
+				continue
+			}
+		}
+		if !ok {
+			e.Members = append(e.Members, MemberError{p.dimmers[i], p.closed[i]})
+			continue
+		}
+		levels = append(levels, level)
+	}
+	if len(e.Members) > 0 {
+		e.Total = len(p.ch)
+		return levels, e
+	}
+	return levels, nil
+}
+
+// Failure of one member of a group.
+type MemberError struct {
+	Dimmer *Dimmer
+	Err    error
+}
+
+// Returned when members of a DimmerGroup fail.
+type DimmerGroupError struct {
+	// Number of members in the command.
+	Total int
+
+	Members []MemberError
+}
+
+func (e *DimmerGroupError) Error() string {
+	var m []string
+	for _, f := range e.Members {
+		m = append(m, fmt.Sprintf("%d: %v", f.Dimmer.id, f.Err))
+	}
+	return fmt.Sprintf("lutron: %d of %d dimmers failed: %s",
+		len(e.Members), e.Total, strings.Join(m, "; "))
+}
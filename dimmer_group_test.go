@@ -0,0 +1,78 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestScale(t *testing.T) {
+	for _, tc := range []struct {
+		level   uint8
+		percent int
+		want    uint8
+	}{
+		{50, 20, 60},
+		{50, -20, 40},
+		{50, 0, 50},
+		{0, 50, 0},
+		{0, -50, 0},
+		{15, 10, 17},  // 1.5 rounds up.
+		{15, -10, 13}, // -1.5 rounds down.
+		{14, 10, 15},  // 1.4 rounds to 1.
+		{14, -10, 13},
+		{5, 5, 5}, // 0.25 rounds to 0.
+		{90, 20, 100},
+		{100, 1, 100},
+		{10, -100, 1},
+		{1, -50, 1},
+		{1, 100, 2},
+		{100, -99, 1},
+		{100, 1000, 100},
+	} {
+		if got := scale(tc.level, tc.percent); got != tc.want {
+			t.Errorf("scale(%d, %d) = %d, want %d", tc.level, tc.percent, got, tc.want)
+		}
+	}
+}
+
+func TestPendingLevelsClosed(t *testing.T) {
+	d := &Dimmer{}
+	d.id = 12
+	closed := make(chan uint8)
+	close(closed)
+	replied := make(chan uint8, 1)
+	replied <- 40
+
+	p := &PendingLevels{}
+	p.add(d, replied, ErrQueueFull)
+	p.add(d, closed, ErrQueueFull)
+	p.add(d, closed, ErrNoReply)
+	p.add(d, make(chan uint8), ErrNoReply)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	levels, err := p.wait(ctx)
+	if len(levels) != 1 || levels[0] != 40 {
+		t.Errorf("levels = %v, want [40]", levels)
+	}
+	var e *DimmerGroupError
+	if !errors.As(err, &e) {
+		t.Fatalf("wait() = %v, want *DimmerGroupError", err)
+	}
+	want := []error{ErrQueueFull, ErrNoReply, context.DeadlineExceeded}
+	if e.Total != 4 || len(e.Members) != len(want) {
+		t.Fatalf("wait() = %v", err)
+	}
+	for i, m := range e.Members {
+		if m.Err != want[i] {
+			t.Errorf("member %d error = %v, want %v", i, m.Err, want[i])
+		}
+	}
+}
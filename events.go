@@ -0,0 +1,256 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of events reported by the main repeater. Kinds may be combined
+// in an EventFilter.
+type EventType uint8
+
+const (
+	OutputEvents EventType = 1 << iota
+	ButtonEvents
+	LedEvents
+	GroupEvents
+	UnknownEvents
+
+	AllEvents = OutputEvents | ButtonEvents | LedEvents | GroupEvents | UnknownEvents
+)
+
+func (t EventType) String() string {
+	switch t {
+	case OutputEvents:
+		return "output"
+	case ButtonEvents:
+		return "button"
+	case LedEvents:
+		return "led"
+	case GroupEvents:
+		return "group"
+	case UnknownEvents:
+		return "unknown"
+	}
+	return "mixed"
+}
+
+// Line received from the main repeater. The concrete type is one of
+// OutputLevelEvent, ButtonEvent, LedEvent, GroupEvent or UnknownEvent.
+type Event interface {
+	Type() EventType
+
+	// Time the line was received.
+	Time() time.Time
+
+	// Integration id of the output, device or group; 0 if unknown.
+	Id() int
+
+	// Line as received, e.g. "~OUTPUT,12,1,50.00".
+	Raw() string
+}
+
+// Fields common to all events.
+type EventInfo struct {
+	At            time.Time
+	IntegrationID int
+	Line          string
+}
+
+func (e *EventInfo) Time() time.Time { return e.At }
+func (e *EventInfo) Id() int         { return e.IntegrationID }
+func (e *EventInfo) Raw() string     { return e.Line }
+
+// Output (dimmer, switch, shade, ...) reached a new target level.
+type OutputLevelEvent struct {
+	EventInfo
+	Level float64 // 0 (off) to 100 (fully on).
+}
+
+// Keypad button was pressed or released.
+type ButtonEvent struct {
+	EventInfo
+	Button uint8
+	Action uint8 // ButtonPress or ButtonRelease.
+}
+
+// Keypad LED changed state.
+type LedEvent struct {
+	EventInfo
+	Button uint8
+	State  uint8 // LedOff, LedOn, LedNormalFlash or LedRapidFlash.
+}
+
+// Occupancy group changed state.
+type GroupEvent struct {
+	EventInfo
+	State uint8 // GroupOccupied, GroupUnoccupied or GroupUnknown.
+}
+
+// Line that is not otherwise understood by this package.
+type UnknownEvent struct {
+	EventInfo
+}
+
+// States of an occupancy group.
+const (
+	GroupOccupied   = 3
+	GroupUnoccupied = 4
+	GroupUnknown    = 255
+)
+
+func (*OutputLevelEvent) Type() EventType { return OutputEvents }
+func (*ButtonEvent) Type() EventType      { return ButtonEvents }
+func (*LedEvent) Type() EventType         { return LedEvents }
+func (*GroupEvent) Type() EventType       { return GroupEvents }
+func (*UnknownEvent) Type() EventType     { return UnknownEvents }
+
+// Selects events delivered to a stream. The zero value selects all events.
+type EventFilter struct {
+	// Kinds of events to deliver; 0 selects all kinds.
+	Types EventType
+
+	// Integration ids to deliver; empty selects all ids.
+	Ids []int
+}
+
+func (f *EventFilter) match(e Event) bool {
+	if f.Types != 0 && f.Types&e.Type() == 0 {
+		return false
+	}
+	if len(f.Ids) == 0 {
+		return true
+	}
+	for _, id := range f.Ids {
+		if id == e.Id() {
+			return true
+		}
+	}
+	return false
+}
+
+type eventStream struct {
+	filter EventFilter
+	sub    *Subscription
+}
+
+// Creates a new channel receiving every event from the main repeater
+// selected by f. A single stream can replace many per-object monitors
+// for logging or rule processing. The stream cannot be stopped and lasts
+// as long as c; use SubscribeEvents for one that can be unsubscribed.
+func (c *Conn) Events(f EventFilter) chan Event {
+	ch := make(chan Event, 5)
+	c.SubscribeEvents(ch, f, MonitorOptions{})
+	return ch
+}
+
+// Adds a channel to receive events selected by f, with the buffering and
+// overflow behavior described by o. Coalesce replaces a waiting level or
+// LED event for the same output or LED.
+func (c *Conn) SubscribeEvents(ch chan Event, f EventFilter, o MonitorOptions) *Subscription {
+	s := newSubscription(o, eventKey,
+		func(e interface{}, done chan struct{}) bool {
+			select {
+			case ch <- e.(Event):
+				return true
+			case <-done:
+				return false
+			}
+		})
+	s.remove = func(s *Subscription) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		var r []eventStream
+		for _, e := range c.streams {
+			if e.sub != s {
+				r = append(r, e)
+			}
+		}
+		c.streams = r
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.streams = append(c.streams, eventStream{f, s})
+	return s
+}
+
+func eventKey(e interface{}) interface{} {
+	type key struct {
+		t      EventType
+		id     int
+		button uint8
+	}
+	switch v := e.(type) {
+	case *OutputLevelEvent:
+		return key{OutputEvents, v.IntegrationID, 0}
+	case *LedEvent:
+		return key{LedEvents, v.IntegrationID, v.Button}
+	}
+	return nil
+}
+
+func (c *Conn) publish(e Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, s := range c.streams {
+		if s.filter.match(e) {
+			s.sub.push(e)
+		}
+	}
+}
+
+// Convert a line received from the main repeater into an Event.
+func newEvent(line string, at time.Time) Event {
+	info := EventInfo{At: at, Line: line}
+	if !strings.HasPrefix(line, "~") {
+		return &UnknownEvent{info}
+	}
+
+	cmd, id, rest, err := parseEvent(line)
+	if err != nil {
+		return &UnknownEvent{info}
+	}
+	info.IntegrationID = id
+
+	n := strings.Split(rest, ",")
+	switch cmd {
+	case "OUTPUT":
+		if len(n) == 2 && n[0] == "1" {
+			if level, err := strconv.ParseFloat(n[1], 64); err == nil {
+				return &OutputLevelEvent{info, level}
+			}
+		}
+
+	case "DEVICE":
+		c, err := strconv.Atoi(n[0])
+		if err != nil {
+			break
+		}
+		if 1 <= c && c <= 25 && len(n) == 2 {
+			if action, err := strconv.Atoi(n[1]); err == nil {
+				return &ButtonEvent{info, uint8(c), uint8(action)}
+			}
+		} else if 81 <= c && c <= 95 && len(n) == 3 && n[1] == "9" {
+			if state, err := strconv.Atoi(n[2]); err == nil {
+				return &LedEvent{info, uint8(c - 80), uint8(state)}
+			}
+		}
+
+	case "GROUP":
+		if len(n) == 2 && n[0] == "3" {
+			if state, err := strconv.Atoi(n[1]); err == nil {
+				return &GroupEvent{info, uint8(state)}
+			}
+		}
+	}
+	return &UnknownEvent{info}
+}
@@ -0,0 +1,373 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package history keeps a log of lighting usage: every level change and
+keypad button press, appended to a local file of JSON lines.
+
+  h, err := history.Open("/var/lib/lutron/history.jsonl")
+  if err != nil {
+    log.Fatal(err)
+  }
+  go h.Record(ctx, conn)
+
+  // Later:
+  for _, u := range h.OnTime(weekAgo, time.Now()) {
+    fmt.Println(u.Day.Format("2006-01-02"), u.Id, u.On)
+  }
+  at, ok := h.LastPress(6, 1)
+  h.WriteCSV(os.Stdout, weekAgo, time.Now())
+
+Entries are kept in memory as well as in the file; Prune discards old
+entries from both.
+*/
+package history
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spearce/lutron"
+	"github.com/spearce/lutron/internal/atomicfile"
+)
+
+// Kind of an Entry.
+type Kind string
+
+const (
+	LevelKind Kind = "level" // Output reached a new level.
+	PressKind Kind = "press" // Keypad button was pressed.
+)
+
+// One recorded level change or button press.
+type Entry struct {
+	At   time.Time `json:"at"`
+	Kind Kind      `json:"kind"`
+
+	// Integration id of the output or keypad.
+	Id int `json:"id"`
+
+	// Button pressed; PressKind only.
+	Button uint8 `json:"button,omitempty"`
+
+	// New level, 0 (off) to 100 (fully on); LevelKind only.
+	Level uint8 `json:"level"`
+
+	// Cause of the level change, as reported by LevelChange.Source;
+	// LevelKind only.
+	Source string `json:"source,omitempty"`
+}
+
+// History of level changes and button presses backed by a file.
+type Store struct {
+	// Location of the days reported by OnTime; time.Local if nil.
+	Location *time.Location
+
+	file string
+
+	mu      sync.Mutex
+	entries []Entry
+	levels  map[int]uint8 // Last recorded level of each output.
+}
+
+// Open the store in file, creating it if it does not exist.
+func Open(file string) (*Store, error) {
+	s := &Store{file: file, levels: make(map[int]uint8)}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("history: %s:%d: %v", file, n, err)
+		}
+		s.entries = append(s.entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(s.entries, func(i, j int) bool {
+		return s.entries[i].At.Before(s.entries[j].At)
+	})
+	for _, e := range s.entries {
+		if e.Kind == LevelKind {
+			s.levels[e.Id] = e.Level
+		}
+	}
+	return s, nil
+}
+
+// Append an entry to the store. An entry older than others already
+// added is kept in time order with them.
+func (s *Store) Add(e Entry) error {
+	b, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].At.After(e.At) })
+	s.entries = append(s.entries, Entry{})
+	copy(s.entries[i+1:], s.entries[i:])
+	s.entries[i] = e
+	if e.Kind == LevelKind && !s.levelAfter(e.Id, i+1) {
+		s.levels[e.Id] = e.Level
+	}
+	return nil
+}
+
+// Whether a level of output id is recorded at or after index i. s.mu
+// must be held.
+func (s *Store) levelAfter(id, i int) bool {
+	for _, e := range s.entries[i:] {
+		if e.Kind == LevelKind && e.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Record level changes of every dimmer and switch, and presses of every
+// keypad button, until ctx is done, returning ctx.Err(). Levels loaded
+// from a state file and reports of an unchanged level are skipped.
+// Every change is recorded: processing of events from the repeater
+// waits if the file falls behind. Entries are stamped with the time they
+// are received here.
+func (s *Store) Record(ctx context.Context, conn *lutron.Conn) error {
+	opts := lutron.MonitorOptions{Buffer: 64, Overflow: lutron.Block}
+	levels := make(chan lutron.LevelChange)
+	lsub := conn.SubscribeDimmers(levels, opts)
+	defer lsub.Unsubscribe()
+
+	events := make(chan lutron.Event)
+	esub := conn.SubscribeEvents(events,
+		lutron.EventFilter{Types: lutron.ButtonEvents}, opts)
+	defer esub.Unsubscribe()
+
+	for {
+		var e Entry
+		select {
+		case lc := <-levels:
+			if lc.Stale || s.unchanged(lc.Dimmer.Id(), lc.Level) {
+				continue
+			}
+			e = Entry{
+				At:     time.Now(),
+				Kind:   LevelKind,
+				Id:     lc.Dimmer.Id(),
+				Level:  lc.Level,
+				Source: lc.Source.String(),
+			}
+		case ev := <-events:
+			b, ok := ev.(*lutron.ButtonEvent)
+			if !ok || b.Action != lutron.ButtonPress {
+				continue
+			}
+			e = Entry{At: time.Now(), Kind: PressKind, Id: b.Id(), Button: b.Button}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := s.Add(e); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Store) unchanged(id int, level uint8) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last, ok := s.levels[id]
+	return ok && last == level
+}
+
+// Entries recorded at or after from and before to.
+func (s *Store) Entries(from, to time.Time) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var r []Entry
+	for _, e := range s.entries {
+		if !e.At.Before(from) && e.At.Before(to) {
+			r = append(r, e)
+		}
+	}
+	return r
+}
+
+// Time an output was above 0 on one day.
+type Usage struct {
+	Id  int
+	Day time.Time // Local midnight starting the day.
+	On  time.Duration
+}
+
+// Time each output was on between from and to, split by local day,
+// ordered by day and then id. Outputs left on are counted until to or
+// the current time, whichever is earlier.
+func (s *Store) OnTime(from, to time.Time) []Usage {
+	if now := time.Now(); to.After(now) {
+		to = now
+	}
+	loc := s.location()
+
+	type key struct {
+		id  int
+		day time.Time
+	}
+	total := make(map[key]time.Duration)
+	add := func(id int, a, b time.Time) {
+		if a.Before(from) {
+			a = from
+		}
+		for a.Before(b) {
+			day := midnight(a.In(loc))
+			end := day.AddDate(0, 0, 1)
+			if end.After(b) {
+				end = b
+			}
+			total[key{id, day}] += end.Sub(a)
+			a = end
+		}
+	}
+
+	on := make(map[int]time.Time)
+	s.mu.Lock()
+	for _, e := range s.entries {
+		if !e.At.Before(to) {
+			break
+		}
+		if e.Kind != LevelKind {
+			continue
+		}
+		start, isOn := on[e.Id]
+		if e.Level > 0 && !isOn {
+			on[e.Id] = e.At
+		} else if e.Level == 0 && isOn {
+			add(e.Id, start, e.At)
+			delete(on, e.Id)
+		}
+	}
+	s.mu.Unlock()
+	for id, start := range on {
+		add(id, start, to)
+	}
+
+	var r []Usage
+	for k, d := range total {
+		r = append(r, Usage{Id: k.id, Day: k.day, On: d})
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if !r[i].Day.Equal(r[j].Day) {
+			return r[i].Day.Before(r[j].Day)
+		}
+		return r[i].Id < r[j].Id
+	})
+	return r
+}
+
+// Time button of keypad was last pressed; false if no press is
+// recorded.
+func (s *Store) LastPress(keypad int, button uint8) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		e := s.entries[i]
+		if e.Kind == PressKind && e.Id == keypad && e.Button == button {
+			return e.At, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Write the entries between from and to as CSV with a header row:
+//
+//   time,kind,id,button,level,source
+//   2014-03-01T19:02:11-08:00,level,12,,75,keypad
+//   2014-03-01T19:02:11-08:00,press,6,1,,
+func (s *Store) WriteCSV(w io.Writer, from, to time.Time) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"time", "kind", "id", "button", "level", "source"})
+	for _, e := range s.Entries(from, to) {
+		rec := []string{
+			e.At.In(s.location()).Format(time.RFC3339),
+			string(e.Kind),
+			strconv.Itoa(e.Id),
+			"", "", "",
+		}
+		switch e.Kind {
+		case PressKind:
+			rec[3] = strconv.Itoa(int(e.Button))
+		case LevelKind:
+			rec[4] = strconv.Itoa(int(e.Level))
+			rec[5] = e.Source
+		}
+		cw.Write(rec)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Discard entries recorded before t, rewriting the file.
+func (s *Store) Prune(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := sort.Search(len(s.entries), func(i int) bool { return !s.entries[i].At.Before(t) })
+	if i == 0 {
+		return nil
+	}
+
+	err := atomicfile.Write(s.file, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, e := range s.entries[i:] {
+			if err := enc.Encode(&e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.entries = append([]Entry(nil), s.entries[i:]...)
+	return nil
+}
+
+func (s *Store) location() *time.Location {
+	if s.Location != nil {
+		return s.Location
+	}
+	return time.Local
+}
+
+func midnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,677 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package httpapi serves a lutron connection as an HTTP/JSON API.
+
+  http.Handle("/", httpapi.New(conn))
+
+Outputs and keypads are addressed by integration id or registered name.
+Only objects already known to the connection are served, such as those
+registered from a names file or the integration report; other ids are
+not found. Levels are 0 to 100; fades are durations such as "2s" or seconds as a
+number; LED states are 0-3 or "off", "on", "flash" and "rapid".
+
+  GET  /outputs                            cached level of known outputs
+  GET  /outputs/{id}                       {"id": 12, "level": 45}
+  PUT  /outputs/{id}                       {"level": 45, "fade": "2s"}
+  GET  /keypads                            known keypads and cached LEDs
+  GET  /keypads/{id}                       {"id": 5, "leds": {"1": 1}}
+  POST /keypads/{id}/buttons/{n}/press
+  GET  /keypads/{id}/buttons/{n}/led       {"keypad": 5, "button": 1, "led": 1}
+  PUT  /keypads/{id}/buttons/{n}/led       {"led": "on"}
+  GET  /ledgroups                          names of groups added by AddLedGroup
+  PUT  /ledgroups/{name}                   {"keypad": 5, "button": 1}
+  GET  /events?types=output,button&ids=12  Server-Sent Events stream
+
+Each message on the event stream has the event type as its name and an
+Event as JSON data. Errors are returned as {"error": "..."}, with status
+404 for unknown names and ids, 400 for invalid requests, 503 if the
+command queue is full and 504 if the repeater does not reply in time.
+
+Set User and Password to require HTTP basic authentication.
+*/
+package httpapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spearce/lutron"
+)
+
+const (
+	// Default time allowed for the repeater to reply to a request.
+	DefaultTimeout = 10 * time.Second
+
+	// Interval of comments sent to keep idle event streams open.
+	keepAlive = 30 * time.Second
+)
+
+// HTTP handler for a connection.
+type Server struct {
+	// Time allowed for the repeater to reply; DefaultTimeout if zero.
+	Timeout time.Duration
+
+	// If set, the Access-Control-Allow-Origin header sent with every
+	// response, allowing browser dashboards on other origins to call
+	// the API.
+	AllowOrigin string
+
+	// If User is set, requests must carry these credentials using HTTP
+	// basic authentication.
+	User     string
+	Password string
+
+	conn *lutron.Conn
+	mux  *http.ServeMux
+
+	mu     sync.Mutex
+	groups map[string]*lutron.LedGroup
+}
+
+// Create a server for conn.
+func New(conn *lutron.Conn) *Server {
+	s := &Server{
+		conn:   conn,
+		mux:    http.NewServeMux(),
+		groups: make(map[string]*lutron.LedGroup),
+	}
+	s.mux.HandleFunc("GET /outputs", s.listOutputs)
+	s.mux.HandleFunc("GET /outputs/{id}", s.getOutput)
+	s.mux.HandleFunc("PUT /outputs/{id}", s.putOutput)
+	s.mux.HandleFunc("GET /keypads", s.listKeypads)
+	s.mux.HandleFunc("GET /keypads/{id}", s.getKeypad)
+	s.mux.HandleFunc("POST /keypads/{id}/buttons/{n}/press", s.press)
+	s.mux.HandleFunc("GET /keypads/{id}/buttons/{n}/led", s.getLed)
+	s.mux.HandleFunc("PUT /keypads/{id}/buttons/{n}/led", s.putLed)
+	s.mux.HandleFunc("GET /ledgroups", s.listGroups)
+	s.mux.HandleFunc("PUT /ledgroups/{name}", s.selectGroup)
+	s.mux.HandleFunc("GET /events", s.events)
+	return s
+}
+
+// Make a group available at /ledgroups/{name}.
+func (s *Server) AddLedGroup(name string, g *lutron.LedGroup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups[name] = g
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", s.AllowOrigin)
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="lutron"`)
+		writeError(w, &httpError{http.StatusUnauthorized, "unauthorized"})
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.User == "" {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	u := subtle.ConstantTimeCompare([]byte(user), []byte(s.User))
+	p := subtle.ConstantTimeCompare([]byte(pass), []byte(s.Password))
+	return ok && u&p == 1
+}
+
+// Level of an output.
+type Output struct {
+	Id    int    `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Level *uint8 `json:"level,omitempty"` // Absent if not yet known.
+	Stale bool   `json:"stale,omitempty"` // Level loaded from the state file.
+}
+
+// Keypad and the cached state of its LEDs, by button number.
+type Keypad struct {
+	Id   int             `json:"id"`
+	Name string          `json:"name,omitempty"`
+	Leds map[uint8]uint8 `json:"leds"`
+}
+
+// LED state of a keypad button.
+type Button struct {
+	Keypad int    `json:"keypad"`
+	Button uint8  `json:"button"`
+	Name   string `json:"name,omitempty"`
+	Led    *uint8 `json:"led,omitempty"`
+}
+
+// Event sent on the /events stream.
+type Event struct {
+	Type   string    `json:"type"` // "output", "button", "led", "group" or "unknown".
+	Time   time.Time `json:"time"`
+	Id     int       `json:"id,omitempty"`
+	Name   string    `json:"name,omitempty"`
+	Level  *float64  `json:"level,omitempty"`  // Output events.
+	Button uint8     `json:"button,omitempty"` // Button and LED events.
+	Action string    `json:"action,omitempty"` // "press" or "release".
+	State  *uint8    `json:"state,omitempty"`  // LED and group events.
+	Raw    string    `json:"raw"`
+}
+
+func (s *Server) listOutputs(w http.ResponseWriter, r *http.Request) {
+	list := []*Output{}
+	for _, d := range s.conn.Dimmers() {
+		o := s.output(d)
+		if l, stale, ok := d.CachedLevel(); ok {
+			o.Level, o.Stale = &l, stale
+		}
+		list = append(list, o)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) getOutput(w http.ResponseWriter, r *http.Request) {
+	d, err := s.dimmer(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	c := d.Level()
+	if r.URL.Query().Get("refresh") != "" {
+		c = d.ReadLevel()
+	}
+	l, err := s.wait(r, c, 0)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	o := s.output(d)
+	o.Level = &l
+	writeJSON(w, http.StatusOK, o)
+}
+
+func (s *Server) putOutput(w http.ResponseWriter, r *http.Request) {
+	d, err := s.dimmer(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var req struct {
+		Level *uint8    `json:"level"`
+		Fade  *duration `json:"fade"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Level == nil || *req.Level > 100 {
+		writeError(w, badRequest("level must be 0 to 100"))
+		return
+	}
+	fade := d.DefaultFade()
+	if req.Fade != nil {
+		fade = time.Duration(*req.Fade)
+	}
+
+	l, err := s.wait(r, d.Fade(*req.Level, fade), fade)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	o := s.output(d)
+	o.Level = &l
+	writeJSON(w, http.StatusOK, o)
+}
+
+func (s *Server) listKeypads(w http.ResponseWriter, r *http.Request) {
+	list := []*Keypad{}
+	for _, k := range s.conn.Keypads() {
+		list = append(list, s.keypad(k))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) getKeypad(w http.ResponseWriter, r *http.Request) {
+	k, err := s.lookupKeypad(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.keypad(k))
+}
+
+func (s *Server) press(w http.ResponseWriter, r *http.Request) {
+	b, err := s.button(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, err := s.wait(r, b.Press(), 0); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getLed(w http.ResponseWriter, r *http.Request) {
+	b, err := s.button(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var c chan uint8
+	if state, _, ok := b.CachedLed(); ok && r.URL.Query().Get("refresh") == "" {
+		c = make(chan uint8, 1)
+		c <- state
+	} else {
+		c = b.ReadLed()
+	}
+	state, err := s.wait(r, c, 0)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	v := s.buttonInfo(b)
+	v.Led = &state
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) putLed(w http.ResponseWriter, r *http.Request) {
+	b, err := s.button(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var req struct {
+		Led *ledState `json:"led"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Led == nil {
+		writeError(w, badRequest("led is required"))
+		return
+	}
+	state, err := s.wait(r, b.SetLed(uint8(*req.Led)), 0)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	v := s.buttonInfo(b)
+	v.Led = &state
+	writeJSON(w, http.StatusOK, v)
+}
+
+func (s *Server) listGroups(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	names := []string{}
+	for n := range s.groups {
+		names = append(names, n)
+	}
+	s.mu.Unlock()
+
+	sort.Strings(names)
+	writeJSON(w, http.StatusOK, names)
+}
+
+// Select a button of a group, or turn off every LED if no button is
+// given.
+func (s *Server) selectGroup(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	g := s.groups[r.PathValue("name")]
+	s.mu.Unlock()
+	if g == nil {
+		writeError(w, notFound("no LED group %q", r.PathValue("name")))
+		return
+	}
+
+	var req struct {
+		Keypad int   `json:"keypad"`
+		Button uint8 `json:"button"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	var sel *lutron.KeypadButton
+	if req.Button != 0 {
+		k, err := s.knownKeypad(req.Keypad)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		sel = k.Button(req.Button)
+	}
+
+	ctx, cancel := s.context(r, 0)
+	defer cancel()
+	if err := replyError(r, g.Select(sel).WaitContext(ctx)); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Stream events as Server-Sent Events until the client disconnects.
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, errors.New("streaming not supported"))
+		return
+	}
+	f, err := parseFilter(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ch := make(chan lutron.Event)
+	sub := s.conn.SubscribeEvents(ch, f, lutron.MonitorOptions{Buffer: 64})
+	defer sub.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	tick := time.NewTicker(keepAlive)
+	defer tick.Stop()
+	for {
+		select {
+		case e := <-ch:
+			b, err := json.Marshal(s.event(e))
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type(), b); err != nil {
+				return
+			}
+		case <-tick.C:
+			if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func parseFilter(r *http.Request) (lutron.EventFilter, error) {
+	var f lutron.EventFilter
+	q := r.URL.Query()
+	for _, t := range splitList(q.Get("types")) {
+		switch t {
+		case "output":
+			f.Types |= lutron.OutputEvents
+		case "button":
+			f.Types |= lutron.ButtonEvents
+		case "led":
+			f.Types |= lutron.LedEvents
+		case "group":
+			f.Types |= lutron.GroupEvents
+		case "unknown":
+			f.Types |= lutron.UnknownEvents
+		default:
+			return f, badRequest("unknown event type %q", t)
+		}
+	}
+	for _, v := range splitList(q.Get("ids")) {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return f, badRequest("invalid id %q", v)
+		}
+		f.Ids = append(f.Ids, id)
+	}
+	return f, nil
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func (s *Server) event(e lutron.Event) *Event {
+	v := &Event{
+		Type: e.Type().String(),
+		Time: e.Time(),
+		Id:   e.Id(),
+		Raw:  e.Raw(),
+	}
+	switch e := e.(type) {
+	case *lutron.OutputLevelEvent:
+		v.Name = s.conn.NameOfOutput(e.Id())
+		v.Level = &e.Level
+	case *lutron.ButtonEvent:
+		v.Name = s.conn.NameOfButton(e.Id(), e.Button)
+		v.Button = e.Button
+		switch e.Action {
+		case lutron.ButtonPress:
+			v.Action = "press"
+		case lutron.ButtonRelease:
+			v.Action = "release"
+		default:
+			v.Action = strconv.Itoa(int(e.Action))
+		}
+	case *lutron.LedEvent:
+		v.Name = s.conn.NameOfButton(e.Id(), e.Button)
+		v.Button = e.Button
+		v.State = &e.State
+	case *lutron.GroupEvent:
+		v.State = &e.State
+	}
+	return v
+}
+
+func (s *Server) output(d *lutron.Dimmer) *Output {
+	return &Output{Id: d.Id(), Name: s.conn.NameOfOutput(d.Id())}
+}
+
+func (s *Server) keypad(k *lutron.Keypad) *Keypad {
+	return &Keypad{
+		Id:   k.Id(),
+		Name: s.conn.NameOfDevice(k.Id()),
+		Leds: k.CachedLeds(),
+	}
+}
+
+func (s *Server) buttonInfo(b *lutron.KeypadButton) *Button {
+	k := b.Keypad().Id()
+	return &Button{Keypad: k, Button: b.Id(), Name: s.conn.NameOfButton(k, b.Id())}
+}
+
+// Find a known output by integration id or name.
+func (s *Server) dimmer(v string) (*lutron.Dimmer, error) {
+	if id, err := strconv.Atoi(v); err == nil {
+		if d, ok := s.conn.KnownDimmer(id); ok {
+			return d, nil
+		}
+		return nil, notFound("unknown output %d", id)
+	}
+	d, err := s.conn.LookupDimmer(v)
+	if err != nil {
+		return nil, lookupError(err)
+	}
+	return d, nil
+}
+
+// Find a known keypad by integration id or name.
+func (s *Server) lookupKeypad(v string) (*lutron.Keypad, error) {
+	if id, err := strconv.Atoi(v); err == nil {
+		return s.knownKeypad(id)
+	}
+	k, err := s.conn.LookupKeypad(v)
+	if err != nil {
+		return nil, lookupError(err)
+	}
+	return k, nil
+}
+
+func (s *Server) knownKeypad(id int) (*lutron.Keypad, error) {
+	if k, ok := s.conn.KnownKeypad(id); ok {
+		return k, nil
+	}
+	return nil, notFound("unknown keypad %d", id)
+}
+
+func (s *Server) button(r *http.Request) (*lutron.KeypadButton, error) {
+	k, err := s.lookupKeypad(r.PathValue("id"))
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseUint(r.PathValue("n"), 10, 8)
+	if err != nil || n < 1 || n > 25 {
+		return nil, badRequest("invalid button %q", r.PathValue("n"))
+	}
+	return k.Button(uint8(n)), nil
+}
+
+// Context of a request limited to the time allowed for the repeater to
+// reply, plus extra.
+func (s *Server) context(r *http.Request, extra time.Duration) (context.Context, context.CancelFunc) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return context.WithTimeout(r.Context(), timeout+extra)
+}
+
+// Wait for a reply from the repeater, allowing extra time for a fade.
+func (s *Server) wait(r *http.Request, c chan uint8, extra time.Duration) (uint8, error) {
+	ctx, cancel := s.context(r, extra)
+	defer cancel()
+	v, err := lutron.Wait(ctx, c)
+	return v, replyError(r, err)
+}
+
+// Report a timeout waiting for the repeater, rather than for the client,
+// as 504.
+func replyError(r *http.Request, err error) error {
+	if err == context.DeadlineExceeded && r.Context().Err() == nil {
+		return &httpError{http.StatusGatewayTimeout, "no reply from repeater"}
+	}
+	return err
+}
+
+// Fade duration, given in JSON as a duration string or seconds.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case float64:
+		if v >= 0 {
+			*d = duration(v * float64(time.Second))
+			return nil
+		}
+	case string:
+		if t, err := time.ParseDuration(v); err == nil && t >= 0 {
+			*d = duration(t)
+			return nil
+		}
+	}
+	return badRequest("invalid fade %s", b)
+}
+
+// LED state, given in JSON as a number or name.
+type ledState uint8
+
+func (l *ledState) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch v {
+	case float64(lutron.LedOff), "off":
+		*l = lutron.LedOff
+	case float64(lutron.LedOn), "on":
+		*l = lutron.LedOn
+	case float64(lutron.LedNormalFlash), "flash":
+		*l = lutron.LedNormalFlash
+	case float64(lutron.LedRapidFlash), "rapid":
+		*l = lutron.LedRapidFlash
+	default:
+		return badRequest("invalid LED state %s", b)
+	}
+	return nil
+}
+
+// Error carrying the HTTP status to report.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (e *httpError) Error() string {
+	return e.msg
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &httpError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &httpError{http.StatusNotFound, fmt.Sprintf(format, args...)}
+}
+
+func lookupError(err error) error {
+	switch err.(type) {
+	case *lutron.UnknownNameError, *lutron.NameTypeError:
+		return &httpError{http.StatusNotFound, err.Error()}
+	case *lutron.AmbiguousNameError:
+		return &httpError{http.StatusConflict, err.Error()}
+	}
+	return err
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<16))
+	if err := dec.Decode(v); err != nil && err != io.EOF {
+		var h *httpError
+		if errors.As(err, &h) {
+			return h
+		}
+		return badRequest("invalid JSON: %v", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var h *httpError
+	switch {
+	case errors.As(err, &h):
+		status = h.status
+	case err == lutron.ErrQueueFull:
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
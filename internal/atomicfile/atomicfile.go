@@ -0,0 +1,76 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package atomicfile replaces files so that readers, and the process
+// itself after a crash, see either the old or the new contents.
+package atomicfile
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Write the contents of file through write, which is given a buffered
+// temporary file in the same directory that is synced to disk and
+// renamed over file once write returns. The new file keeps the mode of
+// the one it replaces, or 0644 if there was none. The temporary file is
+// removed if any step fails, and file is left unchanged.
+func Write(file string, write func(w io.Writer) error) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(file); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	dir := filepath.Dir(file)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	if err := fill(tmp, mode, write); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Write the contents of tmp through write and sync them to disk.
+func fill(tmp *os.File, mode os.FileMode, write func(w io.Writer) error) error {
+	if err := tmp.Chmod(mode); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	if err := write(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return tmp.Sync()
+}
+
+// Sync dir so a rename within it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -7,7 +7,6 @@ package lutron
 
 import (
 	"fmt"
-	"log"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,17 +34,21 @@ const (
 type Keypad struct {
 	Component
 
-	mu      sync.Mutex
-	buttons []keypadMonitor
-	pressed []keypadMonitor
-	leds    []*ledMonitor
-	pending []ledMonitor
+	mu         sync.Mutex
+	buttons    []keypadMonitor
+	pressed    []keypadMonitor
+	leds       []*ledMonitor
+	ledReaders []keypadMonitor
+	pending    []ledMonitor
+	states     map[uint8]uint8 // Last state reported for each LED.
+	stale      map[uint8]uint8 // LED states loaded from the state file.
 }
 
 type keypadMonitor struct {
 	id     uint8
 	events uint8
-	signal chan uint8
+	signal chan uint8    // One-shot reply, closed after sending.
+	sub    *Subscription // Monitor receiving every matching event.
 }
 
 type ledMonitor struct {
@@ -65,9 +68,20 @@ func (k *Keypad) Button(button uint8) *KeypadButton {
 	return &KeypadButton{k, button}
 }
 
+// Keypad the button is located on.
+func (b *KeypadButton) Keypad() *Keypad {
+	return b.k
+}
+
+// Number of the button on its keypad, as passed to Keypad.Button.
+func (b *KeypadButton) Id() uint8 {
+	return b.id
+}
+
 // Press the button on the keypad by sending ButtonPress immediately
 // followed by ButtonRelease. The returned channel is signaled once
-// with ButtonRelease when the repeater has acknowledged the action.
+// with ButtonRelease when the repeater has acknowledged the action,
+// or closed without a value if the commands cannot be queued.
 //
 // If the application is monitoring the button the monitoring channel(s)
 // will also be signaled as the repeater acknowledges the action.
@@ -77,17 +91,33 @@ func (b *KeypadButton) Press() chan uint8 {
 	defer k.mu.Unlock()
 
 	c := make(chan uint8, 1)
+	err := k.executeAll(
+		fmt.Sprintf("%d,%d", b.id, ButtonPress),
+		fmt.Sprintf("%d,%d", b.id, ButtonRelease))
+	if err != nil {
+		close(c)
+		return c
+	}
 	m := keypadMonitor{id: b.id, events: 1 << ButtonRelease, signal: c}
 	k.pressed = append(k.pressed, m)
-	k.Execute(fmt.Sprintf("%d,%d", b.id, ButtonPress))
-	k.Execute(fmt.Sprintf("%d,%d", b.id, ButtonRelease))
 	return c
 }
 
 // Set the state of a button's LED to LedOn, LedOff, LedNormalFlash
 // or LedRapidFlash. LED states can only be set if the button is
-// unconfigured in the RadioRA2 software.
+// unconfigured in the RadioRA2 software. The returned channel is
+// closed without a value if the command cannot be queued.
 func (b *KeypadButton) SetLed(state uint8) chan uint8 {
+	c, err := b.setLed(state)
+	if err != nil {
+		c = make(chan uint8)
+		close(c)
+	}
+	return c
+}
+
+// SetLed, returning ErrQueueFull rather than a closed channel.
+func (b *KeypadButton) setLed(state uint8) (chan uint8, error) {
 	k := b.k
 	k.mu.Lock()
 	defer k.mu.Unlock()
@@ -97,79 +127,127 @@ func (b *KeypadButton) SetLed(state uint8) chan uint8 {
 			id:     b.id,
 			signal: make(chan uint8, 1)},
 		state: state}
+	if err := k.Execute(fmt.Sprintf("%d,9,%d", 80+b.id, state)); err != nil {
+		return nil, err
+	}
 	k.pending = append(k.pending, m)
-	k.Execute(fmt.Sprintf("%d,9,%d", 80+b.id, state))
-	return m.signal
+	return m.signal, nil
 }
 
 // Creates a new channel receiving ButtonPress each time the button
-// is pressed. ButtonRelease events are not sent.
+// is pressed. ButtonRelease events are not sent. Every press is
+// delivered; if the channel is not received from, processing of events
+// from the main repeater stalls once the buffer fills. Use Subscribe
+// for non-blocking delivery, or to be able to stop monitoring.
 func (b *KeypadButton) Monitor() chan uint8 {
-	k := b.k
-	m := keypadMonitor{
-		id:     b.id,
-		events: 1 << ButtonPress,
-		signal: make(chan uint8, 5)}
-
-	k.mu.Lock()
-	defer k.mu.Unlock()
-	k.buttons = append(k.buttons, m)
-	return m.signal
+	c := make(chan uint8, 5)
+	b.Subscribe(c, blockingMonitor)
+	return c
 }
 
 // Creates a new channel receiving ButtonPress followed by ButtonRelease
 // each time the button is pressed. The common usage is to monitor only
 // ButtonPress with Monitor() as most callers do not need to observe
-// ButtonRelease.
+// ButtonRelease. Events are delivered as by Monitor.
 func (b *KeypadButton) MonitorButton() chan uint8 {
+	c := make(chan uint8, 10)
+	b.Subscribe(c, blockingMonitor, ButtonPress, ButtonRelease)
+	return c
+}
+
+// Adds a channel to receive the selected button events, with the
+// buffering and overflow behavior described by o. If no events are
+// selected only ButtonPress is sent. Button events are never coalesced;
+// Coalesce drops the oldest event on overflow.
+func (b *KeypadButton) Subscribe(c chan uint8, o MonitorOptions, events ...uint8) *Subscription {
+	if len(events) == 0 {
+		events = []uint8{ButtonPress}
+	}
+
 	k := b.k
-	m := keypadMonitor{
-		id:     b.id,
-		events: (1 << ButtonPress) | (1 << ButtonRelease),
-		signal: make(chan uint8, 10)}
+	s := stateSubscription(c, o, false)
+	s.remove = k.detach
+	m := keypadMonitor{id: b.id, events: eventMask(events), sub: s}
 
 	k.mu.Lock()
 	defer k.mu.Unlock()
 	k.buttons = append(k.buttons, m)
-	return m.signal
+	return s
 }
 
 // Creates a new channel receiving LED state change events. Monitoring LEDs
 // can be a useful way to react when a specific scene is selected or lights
 // in a room are turned on or turned off.  If no events are selected LedOff
-// and LedOn will be selected by default.
+// and LedOn will be selected by default. Events are delivered as by
+// Monitor; use SubscribeLed to be able to stop monitoring.
 func (b *KeypadButton) MonitorLed(events ...uint8) chan uint8 {
-	var mask uint8 = 0
+	c := make(chan uint8, 5)
+	b.SubscribeLed(c, blockingMonitor, events...)
+	return c
+}
+
+// Adds a channel to receive LED state change events, with the buffering
+// and overflow behavior described by o. See MonitorLed.
+func (b *KeypadButton) SubscribeLed(c chan uint8, o MonitorOptions, events ...uint8) *Subscription {
 	if len(events) == 0 {
-		mask = (1 << LedOff) | (1 << LedOn)
-	} else {
-		for _, e := range events {
-			mask = mask | uint8(1<<e)
-		}
+		events = []uint8{LedOff, LedOn}
 	}
 
 	k := b.k
+	s := stateSubscription(c, o, true)
+	s.remove = k.detach
 	m := &ledMonitor{keypadMonitor: keypadMonitor{
 		id:     b.id,
-		events: mask,
-		signal: make(chan uint8, 5)}}
+		events: eventMask(events),
+		sub:    s}}
 
 	k.mu.Lock()
 	defer k.mu.Unlock()
 
-	for _, e := range k.leds {
-		if e.valid && e.id == m.id {
-			m.state = e.state
-			m.valid = true
-			m.signal <- e.state
-		}
+	if st, ok := k.states[m.id]; ok {
+		m.state = st
+		m.valid = true
 	}
 
-	if !m.valid {
+	if m.valid {
+		s.push(m.state)
+	} else if st, ok := k.stale[m.id]; ok {
+		// State will be confirmed by the background refresh.
+		s.push(st)
+	} else {
 		k.Query(fmt.Sprintf("%d,9", 80+m.id))
 	}
 	k.leds = append(k.leds, m)
-	return m.signal
+	return s
+}
+
+func (k *Keypad) detach(s *Subscription) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var buttons []keypadMonitor
+	for _, m := range k.buttons {
+		if m.sub != s {
+			buttons = append(buttons, m)
+		}
+	}
+	k.buttons = buttons
+
+	var leds []*ledMonitor
+	for _, m := range k.leds {
+		if m.sub != s {
+			leds = append(leds, m)
+		}
+	}
+	k.leds = leds
+}
+
+func eventMask(events []uint8) uint8 {
+	var mask uint8 = 0
+	for _, e := range events {
+		mask = mask | uint8(1<<e)
+	}
+	return mask
 }
 
 func (k *Keypad) handleEvent(event string) error {
@@ -194,7 +272,7 @@ func (k *Keypad) handleEvent(event string) error {
 		}
 		k.handleLed(uint8(c-80), uint8(state))
 	} else {
-		log.Printf("keypad %d ignoring %s", k.Id, event)
+		k.Conn.log.Debug("lutron keypad ignoring event", "id", k.id, "args", event)
 	}
 	return nil
 }
@@ -205,10 +283,16 @@ func (k *Keypad) handleButton(button, action uint8) {
 
 	for _, b := range k.buttons {
 		if b.id == button && b.events&(1<<action) != 0 {
-			b.signal <- action
+			b.sub.push(action)
 		}
 	}
 
+	ours := false
+	for _, b := range k.pressed {
+		ours = ours || b.id == button
+	}
+	k.Conn.buttonEvent(k.id, button, ours)
+
 	var r []keypadMonitor = nil
 	for _, b := range k.pressed {
 		if b.id == button && b.events&(1<<action) != 0 {
@@ -225,16 +309,29 @@ func (k *Keypad) handleLed(led, state uint8) {
 	k.mu.Lock()
 	defer k.mu.Unlock()
 
+	delete(k.stale, led)
+	if k.states == nil {
+		k.states = make(map[uint8]uint8)
+	}
+	k.states[led] = state
 	for _, e := range k.leds {
 		if e.id == led && e.events&(1<<state) != 0 {
 			if !e.valid || e.state != state {
-				e.signal <- state
+				e.sub.push(state)
 				e.state = state
 				e.valid = true
 			}
 		}
 	}
 
+	for _, r := range k.ledReaders {
+		if r.id == led {
+			r.signal <- state
+			close(r.signal)
+		}
+	}
+	k.ledReaders = removeId(k.ledReaders, led)
+
 	var r []ledMonitor = nil
 	for _, b := range k.pending {
 		if b.id == led && b.state == state {
@@ -247,6 +344,16 @@ func (k *Keypad) handleLed(led, state uint8) {
 	k.pending = r
 }
 
+func removeId(m []keypadMonitor, id uint8) []keypadMonitor {
+	var r []keypadMonitor
+	for _, e := range m {
+		if e.id != id {
+			r = append(r, e)
+		}
+	}
+	return r
+}
+
 func (k *Keypad) reconnect() {
 	k.mu.Lock()
 	defer k.mu.Unlock()
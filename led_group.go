@@ -5,6 +5,8 @@
 
 package lutron
 
+import "context"
+
 // Collection of keypad buttons that should behave like radio buttons.
 // At most one button in the group should have LedOn state.
 type LedGroup struct {
@@ -46,3 +48,18 @@ func (u *PendingLedUpdates) Wait() {
 		<-c
 	}
 }
+
+// Wait for LED updates to be acknowledged by the main repeater, or until
+// ctx is done, returning ctx.Err(). ErrQueueFull is returned if an
+// update could not be queued.
+func (u *PendingLedUpdates) WaitContext(ctx context.Context) error {
+	var err error
+	for _, c := range u.ch {
+		if _, werr := Wait(ctx, c); werr == ErrQueueFull {
+			err = werr
+		} else if werr != nil {
+			return werr
+		}
+	}
+	return err
+}
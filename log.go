@@ -0,0 +1,62 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Level of records describing every line sent to or received from the
+// main repeater. LevelTrace is below slog.LevelDebug, so traffic is only
+// logged by handlers configured for it, or when Conn.Trace is set.
+const LevelTrace = slog.LevelDebug - 4
+
+// Send log records for the connection to l. Records carry structured
+// attributes:
+//
+//   dir      "tx" for commands sent, "rx" for lines received
+//   line     the command or line as sent or received
+//   cmd      integration command, e.g. "OUTPUT" or "DEVICE"
+//   id       integration id
+//   queued   time a command waited in the queue before being sent
+//   latency  time from Fade until the level was acknowledged
+//
+// Traffic is logged at LevelTrace, unexpected lines at slog.LevelWarn.
+// If no logger is supplied, warnings and errors are written to stderr.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Conn) {
+		c.log = l
+	}
+}
+
+func defaultLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(os.Stderr, nil))
+}
+
+// Log a line of traffic with the repeater.
+func (c *Conn) trace(dir, line string, args ...any) {
+	level := LevelTrace
+	if c.Trace {
+		level = slog.LevelInfo
+	}
+	if !c.log.Enabled(context.Background(), level) {
+		return
+	}
+
+	args = append(args, "dir", dir, "line", line)
+	n := strings.SplitN(strings.TrimLeft(line, "~#?"), ",", 3)
+	if len(n) >= 2 {
+		args = append(args, "cmd", n[0])
+		if id, err := strconv.Atoi(n[1]); err == nil {
+			args = append(args, "id", id)
+		}
+	}
+	c.log.Log(context.Background(), level, "lutron "+dir, args...)
+}
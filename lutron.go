@@ -14,8 +14,9 @@ package lutron
 import (
 	"errors"
 	"github.com/ziutek/telnet"
-	"log"
+	"log/slog"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,54 +27,166 @@ const (
 	timeout = 5 * time.Second
 )
 
-type request struct {
-	cmd string
-}
-
 type Conn struct {
-	addr  string
-	user  string
-	pass  string
+	addr string
+	user string
+	pass string
+
+	// Log all traffic with the repeater at slog.LevelInfo.
+	// See WithLogger and LevelTrace.
 	Trace bool
+	log   *slog.Logger
 
-	sock     *telnet.Conn
-	requests chan request
+	sock     Transport
+	dialer   func() (Transport, error) // nil if the transport cannot be re-established.
+	recorder *Recorder
+	queue    *queue
+	closed   chan struct{}
 
 	mu       sync.Mutex
-	monitors []chan LevelChange
+	monitors []*Subscription
 	dimmers  map[int]*Dimmer
 	keypads  map[int]*Keypad
+	streams  []eventStream
+
+	names       map[string]interface{}
+	outputNames map[int]string
+	deviceNames map[int]string
+	buttonNames map[buttonKey]string
+
+	stateFile       string
+	refreshInterval time.Duration
+
+	obsMu     sync.Mutex
+	observers []Observer
+
+	// Last event of each button, and the buttons programmed to set
+	// each output by the integration database. See Source.
+	pressMu  sync.Mutex
+	presses  map[buttonKey]buttonPress
+	controls map[int][]buttonKey
+}
+
+type buttonPress struct {
+	at   time.Time
+	ours bool // Caused by KeypadButton.Press.
 }
 
-func Dial(addr, user, pass string) (*Conn, error) {
-	c := Conn{addr: addr, user: user, pass: pass}
-	t, err := c.dial()
+// Configures optional behavior of a connection. See Dial.
+type Option func(*Conn)
+
+// Connect to the main repeater at addr and log in with the integration
+// user and password. Options such as WithStateFile may be supplied to
+// enable optional features.
+func Dial(addr, user, pass string, opts ...Option) (*Conn, error) {
+	c := newConn(opts)
+	c.addr = addr
+	c.user = user
+	c.pass = pass
+	c.dialer = c.dial
+
+	t, err := c.connect()
 	if err != nil {
 		return nil, err
 	}
-	c.sock = t
-	c.requests = make(chan request, 100)
-	c.dimmers = make(map[int]*Dimmer)
-	c.keypads = make(map[int]*Keypad)
+	if err := c.start(t); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
 
+func newConn(opts []Option) *Conn {
+	c := &Conn{
+		queue:       newQueue(),
+		closed:      make(chan struct{}),
+		dimmers:     make(map[int]*Dimmer),
+		keypads:     make(map[int]*Keypad),
+		names:       make(map[string]interface{}),
+		outputNames: make(map[int]string),
+		deviceNames: make(map[int]string),
+		buttonNames: make(map[buttonKey]string),
+		presses:     make(map[buttonKey]buttonPress),
+		controls:    make(map[int][]buttonKey),
+	}
+	for _, o := range opts {
+		o(c)
+	}
+	if c.log == nil {
+		c.log = defaultLogger()
+	}
+	return c
+}
+
+// Dial the repeater and enable monitoring.
+func (c *Conn) connect() (Transport, error) {
+	t, err := c.dialer()
+	if err != nil {
+		return nil, err
+	}
+	t = c.wrap(t)
+	if err := setup(t); err != nil {
+		t.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// Begin processing traffic on the transport.
+func (c *Conn) start(t Transport) error {
+	if c.stateFile != "" {
+		if err := c.loadState(); err != nil {
+			t.Close()
+			return err
+		}
+	}
+
+	c.sock = t
 	go c.controller()
+	if c.stateFile != "" {
+		go c.refreshState()
+	}
+	return nil
+}
+
+// Close the connection to the repeater. Callers waiting for replies
+// are released. The state file, if any, is saved first; see
+// WithStateFile.
+func (c *Conn) Close() error {
+	select {
+	case <-c.closed:
+		return nil
+	default:
+		close(c.closed)
+	}
+
+	err := c.SaveState()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cerr := c.sock.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func setup(t Transport) error {
 	setup := []string{
 		"#MONITORING,1,2", // Disable diagnostic monitoring
 		"#MONITORING,3,1", // Enable button (device) monitoring
 		"#MONITORING,4,1", // Enable LED (device) monitoring
 		"#MONITORING,5,1", // Enable zone (output) monitoring
+		"#MONITORING,6,1", // Enable occupancy (group) monitoring
 	}
 	for _, s := range setup {
-		if err := sendln(t, s); err != nil {
-			return nil, err
+		if err := t.WriteLine(s); err != nil {
+			return err
 		}
 	}
-	return &c, nil
+	return nil
 }
 
-func reader(sock *telnet.Conn, d chan string, e chan error) {
+func reader(sock Transport, d chan string, e chan error) {
 	for {
-		str, err := sock.ReadString('\n')
+		str, err := sock.ReadLine()
 		if err != nil {
 			e <- err
 			return
@@ -90,37 +203,86 @@ func (c *Conn) controller() {
 	errCh := make(chan error)
 	go reader(c.sock, evtCh, errCh)
 
+	// When rate limited, throttle is non-nil until the next
+	// command may be written to the repeater.
+	var throttle <-chan time.Time
 	for {
+		var ready <-chan struct{}
+		if throttle == nil {
+			ready = c.queue.ready
+		}
+
 		select {
 		case str := <-evtCh:
-			if c.Trace {
-				log.Println(str)
-			}
+			c.trace("rx", str)
 			c.eventFromRepeater(str)
 
 		case err := <-errCh:
-			// TODO(spearce) retry connection
-			log.Fatalln("read error:", err)
+			select {
+			case <-c.closed:
+				c.afterReconnect()
+				return
+			default:
+			}
+			c.sock.Close()
+			if c.dialer == nil {
+				c.log.Info("lutron connection ended", "err", err)
+				c.afterReconnect()
+				return
+			}
+
+			c.log.Error("lutron read failed", "err", err)
+			t, ok := c.redial()
+			if !ok {
+				c.afterReconnect()
+				return
+			}
+			c.mu.Lock()
+			c.sock = t
+			c.mu.Unlock()
+			go reader(t, evtCh, errCh)
 			c.afterReconnect()
+			c.observe(func(o Observer) { o.Reconnected() })
 
-		case req := <-c.requests:
-			if c.Trace {
-				log.Println(req.cmd)
+		case <-ready:
+			req, ok := c.queue.pop()
+			if !ok {
+				break
+			}
+			queued := time.Since(req.queued)
+			c.trace("tx", req.cmd, "queued", queued)
+			c.observe(func(o Observer) { o.CommandSent(req.cmd, queued) })
+			if err := c.sock.WriteLine(req.cmd); err != nil {
+				c.log.Warn("lutron write failed", "line", req.cmd, "err", err)
+			}
+			if c.queue.interval > 0 {
+				throttle = time.After(c.queue.interval)
+			} else if c.queue.length() > 0 {
+				c.queue.wake()
+			}
+
+		case <-throttle:
+			throttle = nil
+			if c.queue.length() > 0 {
+				c.queue.wake()
 			}
-			sendln(c.sock, req.cmd)
 		}
 	}
 }
 
 func (c *Conn) eventFromRepeater(s string) {
+	e := newEvent(s, time.Now())
+	c.observe(func(o Observer) { o.EventReceived(e) })
+	c.publish(e)
+
 	if !strings.HasPrefix(s, "~") {
-		log.Printf("expected ~EVENT, received %#v\n", s)
+		c.log.Warn("lutron expected ~EVENT", "line", s)
 		return
 	}
 
 	cmd, id, rest, err := parseEvent(s)
 	if err != nil {
-		log.Printf("cannot parse %#v: %v\n", s, err)
+		c.log.Warn("lutron cannot parse event", "line", s, "err", err)
 		return
 	}
 	c.processEvent(cmd, id, rest)
@@ -145,17 +307,55 @@ func (c *Conn) processEvent(cmd string, id int, rest string) {
 		i = c.Dimmer(id)
 	case "DEVICE":
 		i = c.Keypad(id)
-	case "MONITORING":
+	case "MONITORING", "GROUP":
 		return
 	default:
-		log.Printf("unsupported %v %v %d", cmd, id, rest)
+		c.log.Debug("lutron unsupported event", "cmd", cmd, "id", id, "args", rest)
 		return
 	}
 	if err := i.handleEvent(rest); err != nil {
-		log.Printf("invalid event %v %v %v", cmd, id, rest)
+		c.log.Warn("lutron invalid event",
+			"cmd", cmd, "id", id, "args", rest, "err", err)
 	}
 }
 
+// Record an event of a keypad button, caused by KeypadButton.Press if
+// ours.
+func (c *Conn) buttonEvent(keypad int, button uint8, ours bool) {
+	c.pressMu.Lock()
+	defer c.pressMu.Unlock()
+	c.presses[buttonKey{keypad, button}] = buttonPress{time.Now(), ours}
+}
+
+// Record that button of keypad is programmed to set output.
+func (c *Conn) addControl(output, keypad int, button uint8) {
+	c.pressMu.Lock()
+	defer c.pressMu.Unlock()
+	key := buttonKey{keypad, button}
+	for _, b := range c.controls[output] {
+		if b == key {
+			return
+		}
+	}
+	c.controls[output] = append(c.controls[output], key)
+}
+
+// Whether a button programmed to set output had an event within
+// buttonWindow and, if so, whether the latest was caused by
+// KeypadButton.Press.
+func (c *Conn) pressedFor(output int) (ours, ok bool) {
+	c.pressMu.Lock()
+	defer c.pressMu.Unlock()
+	var last time.Time
+	for _, b := range c.controls[output] {
+		p, found := c.presses[b]
+		if found && time.Since(p.at) < buttonWindow && p.at.After(last) {
+			last, ours, ok = p.at, p.ours, true
+		}
+	}
+	return ours, ok
+}
+
 func (c *Conn) afterReconnect() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -171,33 +371,47 @@ func (c *Conn) afterReconnect() {
 // Adds a channel to receive updates when any dimmer is adjusted. The current
 // level of every known dimmer will be sent on the channel.
 //
-// Monitoring all dimmers is useful for logging lighting usage over time.
+// Monitoring all dimmers is useful for logging lighting usage over time,
+// as package history does.
 // Specific dimmer monitoring simplifies reacting to lighting changes with
 // other automated actions. To monitor only specific dimmers use:
 //   m := c.Dimmer(id).Monitor()
 // or
 //   c.Dimmer(id).AddMonitor(m)
-func (c *Conn) AddDimmerMonitor(m chan LevelChange) {
+//
+// Every update is delivered, blocking as described for
+// Dimmer.AddMonitor. Unsubscribe the returned subscription to stop.
+func (c *Conn) AddDimmerMonitor(m chan LevelChange) *Subscription {
+	return c.SubscribeDimmers(m, blockingMonitor)
+}
+
+// Adds a channel to receive updates when any dimmer is adjusted, with the
+// buffering and overflow behavior described by o. See AddDimmerMonitor.
+func (c *Conn) SubscribeDimmers(m chan LevelChange, o MonitorOptions) *Subscription {
+	s := levelSubscription(m, o)
+	s.remove = func(s *Subscription) {
+		c.mu.Lock()
+		c.monitors = removeSubscription(c.monitors, s)
+		c.mu.Unlock()
+
+		for _, d := range c.Dimmers() {
+			d.detach(s)
+		}
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.monitors = append(c.monitors, m)
-
-	// Add to existing dimmers in the background in case the
-	// caller is not yet receiving from the channel.
-	q := make([]*Dimmer, 16)
+	c.monitors = append(c.monitors, s)
 	for _, d := range c.dimmers {
-		q = append(q, d)
+		d.attach(s)
 	}
-	go func() {
-		for _, d := range q {
-			d.AddMonitor(m)
-		}
-	}()
+	return s
 }
 
 // Get a reference to a Maestro style dimmer, switch or hybrid keypad.
-// The integration id must be obtained from the RadioRA2 software.
+// The integration id must be obtained from the RadioRA2 software, or
+// looked up by name after LoadDatabase.
 func (c *Conn) Dimmer(id int) *Dimmer {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -209,8 +423,8 @@ func (c *Conn) Dimmer(id int) *Dimmer {
 			command: "OUTPUT",
 			id:      id}}
 		c.dimmers[id] = d
-		for _, m := range c.monitors {
-			d.AddMonitor(m)
+		for _, s := range c.monitors {
+			d.attach(s)
 		}
 	}
 	return d
@@ -250,7 +464,90 @@ func (c *Conn) Keypad(id int) *Keypad {
 	return k
 }
 
-func (c *Conn) dial() (*telnet.Conn, error) {
+// Connect again after the connection to the repeater was lost, retrying
+// with increasing delay until successful or the Conn is closed.
+func (c *Conn) redial() (Transport, bool) {
+	delay := time.Second
+	for {
+		t, err := c.connect()
+		if err == nil {
+			c.log.Info("lutron reconnected", "addr", c.addr)
+			return t, true
+		}
+
+		c.log.Warn("lutron reconnect failed",
+			"addr", c.addr, "err", err, "retry", delay)
+		select {
+		case <-time.After(delay):
+		case <-c.closed:
+			return nil, false
+		}
+		if delay < time.Minute {
+			delay *= 2
+		}
+	}
+}
+
+// Get every dimmer known to the connection, including dimmers created
+// by name registration and the state file.
+func (c *Conn) Dimmers() []*Dimmer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := make([]*Dimmer, 0, len(c.dimmers))
+	for _, d := range c.dimmers {
+		r = append(r, d)
+	}
+	sort.Sort(dimmersById(r))
+	return r
+}
+
+// Get the dimmer with integration id if it is already known to the
+// connection, through Dimmer, a names file, the integration report or
+// the state file. Unlike Dimmer, no object is created and no query is
+// sent, so ids from untrusted clients can be checked safely.
+func (c *Conn) KnownDimmer(id int) (*Dimmer, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.dimmers[id]
+	return d, ok
+}
+
+// Get the keypad with integration id if it is already known to the
+// connection. See KnownDimmer.
+func (c *Conn) KnownKeypad(id int) (*Keypad, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k, ok := c.keypads[id]
+	return k, ok
+}
+
+// Get every keypad known to the connection.
+func (c *Conn) Keypads() []*Keypad {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := make([]*Keypad, 0, len(c.keypads))
+	for _, k := range c.keypads {
+		r = append(r, k)
+	}
+	sort.Sort(keypadsById(r))
+	return r
+}
+
+type dimmersById []*Dimmer
+
+func (a dimmersById) Len() int           { return len(a) }
+func (a dimmersById) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a dimmersById) Less(i, j int) bool { return a[i].id < a[j].id }
+
+type keypadsById []*Keypad
+
+func (a keypadsById) Len() int           { return len(a) }
+func (a keypadsById) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a keypadsById) Less(i, j int) bool { return a[i].id < a[j].id }
+
+func (c *Conn) dial() (Transport, error) {
 	t, err := telnet.Dial("tcp", net.JoinHostPort(c.addr, "23"))
 	if err != nil {
 		return nil, err
@@ -260,7 +557,7 @@ func (c *Conn) dial() (*telnet.Conn, error) {
 		t.Close()
 		return nil, err
 	}
-	return t, nil
+	return &telnetTransport{t}, nil
 }
 
 func (c *Conn) login(t *telnet.Conn) error {
@@ -297,16 +594,3 @@ func expect(t *telnet.Conn, d string) error {
 	}
 	return nil
 }
-
-func sendln(t *telnet.Conn, s string) error {
-	if err := t.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
-		return err
-	}
-
-	buf := make([]byte, len(s)+2)
-	copy(buf, s)
-	buf[len(s)] = '\r'
-	buf[len(s)+1] = '\n'
-	_, err := t.Write(buf)
-	return err
-}
@@ -0,0 +1,179 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package metrics exports Prometheus metrics for a lutron connection.
+
+  m := metrics.New(conn)
+  http.Handle("/metrics", m.Handler())
+
+Exported metrics include commands sent, events received, latency from
+Dimmer.Fade until the level is acknowledged, reconnects, the length of
+the command queue, and the level of every known dimmer and keypad LED.
+*/
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spearce/lutron"
+)
+
+// Prometheus collector instrumenting a connection. Collector may also be
+// registered with another prometheus.Registerer instead of using Handler.
+type Collector struct {
+	conn *lutron.Conn
+	reg  *prometheus.Registry
+
+	commands   *prometheus.CounterVec
+	events     *prometheus.CounterVec
+	latency    prometheus.Histogram
+	reconnects prometheus.Counter
+
+	queueDesc *prometheus.Desc
+	levelDesc *prometheus.Desc
+	ledDesc   *prometheus.Desc
+}
+
+// Create a collector and begin observing conn.
+func New(conn *lutron.Conn) *Collector {
+	m := &Collector{
+		conn: conn,
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lutron_commands_sent_total",
+			Help: "Commands and queries written to the main repeater.",
+		}, []string{"op", "cmd"}),
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lutron_events_received_total",
+			Help: "Lines received from the main repeater, by event type.",
+		}, []string{"type"}),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "lutron_level_ack_seconds",
+			Help:    "Time from Fade until the repeater acknowledged the level.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lutron_reconnects_total",
+			Help: "Connections re-established after the repeater was lost.",
+		}),
+		queueDesc: prometheus.NewDesc("lutron_queue_length",
+			"Commands waiting to be written to the main repeater.",
+			nil, nil),
+		levelDesc: prometheus.NewDesc("lutron_dimmer_level",
+			"Last known level of a dimmer, 0 to 100.",
+			[]string{"id"}, nil),
+		ledDesc: prometheus.NewDesc("lutron_led_state",
+			"Last known state of a keypad LED (0 off, 1 on, 2-3 flashing).",
+			[]string{"keypad", "button"}, nil),
+	}
+
+	m.reg = prometheus.NewRegistry()
+	m.reg.MustRegister(m)
+	conn.AddObserver(observer{m})
+	return m
+}
+
+// HTTP handler serving the metrics, typically installed at "/metrics".
+func (m *Collector) Handler() http.Handler {
+	return promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{})
+}
+
+// Implements prometheus.Collector.
+func (m *Collector) Describe(ch chan<- *prometheus.Desc) {
+	m.commands.Describe(ch)
+	m.events.Describe(ch)
+	m.latency.Describe(ch)
+	m.reconnects.Describe(ch)
+	ch <- m.queueDesc
+	ch <- m.levelDesc
+	ch <- m.ledDesc
+}
+
+// Implements prometheus.Collector.
+func (m *Collector) Collect(ch chan<- prometheus.Metric) {
+	m.commands.Collect(ch)
+	m.events.Collect(ch)
+	m.latency.Collect(ch)
+	m.reconnects.Collect(ch)
+
+	ch <- prometheus.MustNewConstMetric(m.queueDesc,
+		prometheus.GaugeValue, float64(m.conn.QueueLength()))
+
+	for _, d := range m.conn.Dimmers() {
+		if level, _, ok := d.CachedLevel(); ok {
+			ch <- prometheus.MustNewConstMetric(m.levelDesc,
+				prometheus.GaugeValue, float64(level),
+				strconv.Itoa(d.Id()))
+		}
+	}
+	for _, k := range m.conn.Keypads() {
+		for led, state := range k.CachedLeds() {
+			ch <- prometheus.MustNewConstMetric(m.ledDesc,
+				prometheus.GaugeValue, float64(state),
+				strconv.Itoa(k.Id()), strconv.Itoa(int(led)))
+		}
+	}
+}
+
+// Receives activity from the connection. Kept separate from Collector
+// to avoid exporting the lutron.Observer methods.
+type observer struct {
+	m *Collector
+}
+
+// Commands of the integration protocol used as label values. Others,
+// which may be sent as raw lines, are counted as "other" to bound the
+// number of series.
+var knownCommands = map[string]bool{
+	"AREA":          true,
+	"DEVICE":        true,
+	"ETHERNET":      true,
+	"GROUP":         true,
+	"HELP":          true,
+	"HVAC":          true,
+	"INTEGRATIONID": true,
+	"MONITORING":    true,
+	"OUTPUT":        true,
+	"RESET":         true,
+	"SHADEGRP":      true,
+	"SYSTEM":        true,
+	"SYSVAR":        true,
+	"TIMECLOCK":     true,
+}
+
+func (o observer) CommandSent(line string, queued time.Duration) {
+	op, cmd := "other", "other"
+	if line != "" {
+		switch line[0] {
+		case '#':
+			op = "execute"
+		case '?':
+			op = "query"
+		}
+	}
+	if op != "other" {
+		if c := strings.SplitN(line[1:], ",", 2)[0]; knownCommands[c] {
+			cmd = c
+		}
+	}
+	o.m.commands.WithLabelValues(op, cmd).Inc()
+}
+
+func (o observer) EventReceived(e lutron.Event) {
+	o.m.events.WithLabelValues(e.Type().String()).Inc()
+}
+
+func (o observer) LevelAcknowledged(d *lutron.Dimmer, level uint8, latency time.Duration) {
+	o.m.latency.Observe(latency.Seconds())
+}
+
+func (o observer) Reconnected() {
+	o.m.reconnects.Inc()
+}
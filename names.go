@@ -0,0 +1,254 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Table of human readable names for integration ids, usually stored
+// in a YAML or JSON file and loaded with LoadNames:
+//
+//   dimmers:
+//     Kitchen/Island Pendants: 12
+//   switches:
+//     Kitchen/Disposal: 14
+//   keypads:
+//     Front Door Keypad: 6
+//   buttons:
+//     Front Door Keypad/Goodnight: {keypad: 6, button: 5}
+type Names struct {
+	Dimmers       map[string]int        `json:"dimmers" yaml:"dimmers"`
+	Switches      map[string]int        `json:"switches" yaml:"switches"`
+	Keypads       map[string]int        `json:"keypads" yaml:"keypads"`
+	HybridKeypads map[string]int        `json:"hybrid_keypads" yaml:"hybrid_keypads"`
+	Buttons       map[string]ButtonName `json:"buttons" yaml:"buttons"`
+}
+
+// Location of a named keypad button.
+type ButtonName struct {
+	Keypad int   `json:"keypad" yaml:"keypad"`
+	Button uint8 `json:"button" yaml:"button"`
+}
+
+// Returned by Lookup when no object is registered under the name.
+type UnknownNameError struct {
+	Name string
+}
+
+func (e *UnknownNameError) Error() string {
+	return fmt.Sprintf("lutron: unknown name %q", e.Name)
+}
+
+// Returned by Lookup when a partial name matches more than one object.
+type AmbiguousNameError struct {
+	Name    string
+	Matches []string
+}
+
+func (e *AmbiguousNameError) Error() string {
+	return fmt.Sprintf("lutron: %q is ambiguous: %s",
+		e.Name, strings.Join(e.Matches, ", "))
+}
+
+// Returned by the typed lookup methods when the name refers to an
+// object of a different type, such as LookupDimmer on a keypad.
+type NameTypeError struct {
+	Name   string
+	Object interface{}
+}
+
+func (e *NameTypeError) Error() string {
+	return fmt.Sprintf("lutron: %q is %T", e.Name, e.Object)
+}
+
+// Read a YAML (.yaml, .yml) or JSON file of names and register them.
+func (c *Conn) LoadNames(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var n Names
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &n)
+	default:
+		err = json.Unmarshal(b, &n)
+	}
+	if err != nil {
+		return fmt.Errorf("lutron: %s: %v", file, err)
+	}
+	c.AddNames(&n)
+	return nil
+}
+
+// Register every object in the table of names.
+func (c *Conn) AddNames(n *Names) {
+	for name, id := range n.Dimmers {
+		c.register(name, c.Dimmer(id))
+	}
+	for name, id := range n.Switches {
+		c.register(name, c.Switch(id))
+	}
+	for name, id := range n.Keypads {
+		c.register(name, c.Keypad(id))
+	}
+	for name, id := range n.HybridKeypads {
+		c.register(name, c.HybridKeypad(id))
+	}
+	for name, b := range n.Buttons {
+		c.register(name, c.Keypad(b.Keypad).Button(b.Button))
+	}
+}
+
+// Find the object registered under name by AddDatabase or AddNames.
+// The result is a *Dimmer, *Switch, *Keypad, *HybridKeypad or
+// *KeypadButton; callers may prefer LookupDimmer, LookupKeypad or
+// LookupButton.
+//
+// Names are paths separated by "/". If name does not exactly match
+// a registered name, it may match the trailing components of one,
+// ignoring case: "Front Door Keypad/Goodnight" finds
+// "Foyer/Front Door Keypad/Goodnight". An *UnknownNameError or
+// *AmbiguousNameError is returned if there is not exactly one match.
+func (c *Conn) Lookup(name string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if obj, ok := c.names[name]; ok {
+		return obj, nil
+	}
+
+	suffix := strings.ToLower(name)
+	var matches []string
+	for n := range c.names {
+		l := strings.ToLower(n)
+		if l == suffix || strings.HasSuffix(l, "/"+suffix) {
+			matches = append(matches, n)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, &UnknownNameError{name}
+	case 1:
+		return c.names[matches[0]], nil
+	}
+	sort.Strings(matches)
+	return nil, &AmbiguousNameError{name, matches}
+}
+
+// Find a dimmer, switch or hybrid keypad's dimmer by name. See Lookup.
+func (c *Conn) LookupDimmer(name string) (*Dimmer, error) {
+	obj, err := c.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	switch v := obj.(type) {
+	case *Dimmer:
+		return v, nil
+	case *Switch:
+		return v.dimmer, nil
+	case *HybridKeypad:
+		return v.Dimmer, nil
+	}
+	return nil, &NameTypeError{name, obj}
+}
+
+// Find a keypad or hybrid keypad's keypad by name. See Lookup.
+func (c *Conn) LookupKeypad(name string) (*Keypad, error) {
+	obj, err := c.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	switch v := obj.(type) {
+	case *Keypad:
+		return v, nil
+	case *HybridKeypad:
+		return v.Keypad, nil
+	}
+	return nil, &NameTypeError{name, obj}
+}
+
+// Find a keypad button by name. See Lookup.
+func (c *Conn) LookupButton(name string) (*KeypadButton, error) {
+	obj, err := c.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if b, ok := obj.(*KeypadButton); ok {
+		return b, nil
+	}
+	return nil, &NameTypeError{name, obj}
+}
+
+// Names of all registered objects, sorted.
+func (c *Conn) ListNames() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := make([]string, 0, len(c.names))
+	for n := range c.names {
+		r = append(r, n)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// Get the registered name of an output (dimmer or switch), or "" if
+// the output has no name.
+func (c *Conn) NameOfOutput(id int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.outputNames[id]
+}
+
+// Get the registered name of a keypad, or "" if the keypad has no name.
+func (c *Conn) NameOfDevice(id int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deviceNames[id]
+}
+
+// Get the registered name of a keypad button, or "" if it has no name.
+func (c *Conn) NameOfButton(keypad int, button uint8) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buttonNames[buttonKey{keypad, button}]
+}
+
+type buttonKey struct {
+	keypad int
+	button uint8
+}
+
+func (c *Conn) register(name string, obj interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.names[name] = obj
+	switch v := obj.(type) {
+	case *Dimmer:
+		c.outputNames[v.id] = name
+	case *Switch:
+		c.outputNames[v.dimmer.id] = name
+	case *Keypad:
+		c.deviceNames[v.id] = name
+	case *HybridKeypad:
+		c.outputNames[v.Dimmer.id] = name
+		c.deviceNames[v.Keypad.id] = name
+	case *KeypadButton:
+		c.buttonNames[buttonKey{v.k.id, v.id}] = name
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import "time"
+
+// Receives notifications of connection activity, for example to export
+// metrics. Methods are called synchronously from the goroutine processing
+// repeater traffic, sometimes while holding internal locks; they must
+// return quickly and must not call methods on the Conn or its objects.
+type Observer interface {
+	// A command or query was written to the main repeater after
+	// waiting in the command queue.
+	CommandSent(line string, queued time.Duration)
+
+	// A line was received from the main repeater.
+	EventReceived(e Event)
+
+	// The level requested by Fade was acknowledged by the repeater.
+	LevelAcknowledged(d *Dimmer, level uint8, latency time.Duration)
+
+	// The connection was lost and has been established again.
+	Reconnected()
+}
+
+// Add an observer to be notified of connection activity.
+func (c *Conn) AddObserver(o Observer) {
+	c.obsMu.Lock()
+	defer c.obsMu.Unlock()
+	c.observers = append(c.observers, o)
+}
+
+// Remove an observer added by AddObserver. o must be comparable.
+func (c *Conn) RemoveObserver(o Observer) {
+	c.obsMu.Lock()
+	defer c.obsMu.Unlock()
+	for i, e := range c.observers {
+		if e == o {
+			c.observers = append(c.observers[:i:i], c.observers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (c *Conn) observe(f func(Observer)) {
+	c.obsMu.Lock()
+	defer c.obsMu.Unlock()
+	for _, o := range c.observers {
+		f(o)
+	}
+}
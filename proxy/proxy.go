@@ -0,0 +1,430 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package proxy shares one integration session with the main repeater
+among many telnet clients.
+
+The main repeater accepts only a few simultaneous integration sessions.
+A proxy holds a single upstream lutron.Conn and accepts any number of
+downstream clients, which log in to the proxy as they would to the
+repeater, so existing clients (including lutron.Dial) work unchanged:
+
+  conn, _ := lutron.Dial(repeater, "lutron", "integration")
+  p := proxy.New(conn, "proxyuser", "proxypass")
+  log.Fatal(p.ListenAndServe(":23"))
+
+Every ~ event from the repeater is sent to every client. Commands and
+queries from clients are serialized through the connection's command
+queue. Queries for an output level or LED state known to the connection
+are answered from its cache without contacting the repeater; other
+query replies are events, and are sent to every client.
+
+#MONITORING commands are handled by the proxy for the client sending
+them: type 12 turns the GNET> prompt on or off, and types 3 (buttons),
+4 (LEDs), 5 (outputs) and 6 (occupancy) select the events sent to it.
+*/
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spearce/lutron"
+)
+
+const (
+	// Time allowed for a client to log in.
+	loginTimeout = 30 * time.Second
+
+	// Time allowed to write to a client before it is disconnected.
+	writeTimeout = 10 * time.Second
+
+	// Failed logins before a client is disconnected.
+	loginAttempts = 3
+
+	// Events held for a slow client before the oldest is dropped.
+	clientBuffer = 256
+
+	prompt = "GNET> \x00"
+)
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("proxy: server closed")
+
+// Telnet integration server backed by a connection.
+type Server struct {
+	// Logger for client activity; slog.Default() if nil.
+	Logger *slog.Logger
+
+	conn *lutron.Conn
+	user string
+	pass string
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	clients   map[*client]bool
+	closed    bool
+}
+
+// Create a server relaying for conn. Clients must log in with user and
+// pass, which need not match the repeater's credentials.
+func New(conn *lutron.Conn, user, pass string) *Server {
+	return &Server{
+		conn:      conn,
+		user:      user,
+		pass:      pass,
+		listeners: make(map[net.Listener]bool),
+		clients:   make(map[*client]bool),
+	}
+}
+
+// Listen on the TCP address addr and serve clients.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Accept clients on l until Close is called. l is closed on return.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+		l.Close()
+	}()
+
+	for {
+		nc, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serveClient(nc)
+	}
+}
+
+// Stop accepting clients and disconnect all clients. The upstream
+// connection is not closed.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.clients {
+		c.nc.Close()
+	}
+	return nil
+}
+
+// Number of clients currently logged in.
+func (s *Server) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+type client struct {
+	s   *Server
+	nc  net.Conn
+	r   *bufio.Reader
+	log *slog.Logger
+
+	mu       sync.Mutex // Held while writing to nc.
+	prompt   bool
+	disabled lutron.EventType
+}
+
+func (s *Server) serveClient(nc net.Conn) {
+	c := &client{
+		s:      s,
+		nc:     nc,
+		r:      bufio.NewReader(nc),
+		log:    s.logger().With("client", nc.RemoteAddr().String()),
+		prompt: true,
+	}
+	defer nc.Close()
+
+	if !c.login() {
+		return
+	}
+	if !s.add(c) {
+		return
+	}
+	defer s.remove(c)
+	c.log.Info("proxy client connected")
+
+	events := make(chan lutron.Event)
+	sub := s.conn.SubscribeEvents(events, lutron.EventFilter{},
+		lutron.MonitorOptions{Buffer: clientBuffer, Overflow: lutron.DropOldest})
+	done := make(chan struct{})
+	go c.forward(events, done)
+
+	err := c.serve()
+	sub.Unsubscribe()
+	close(done)
+	c.log.Info("proxy client disconnected", "err", err, "dropped", sub.Dropped())
+}
+
+func (s *Server) add(c *client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.clients[c] = true
+	return true
+}
+
+func (s *Server) remove(c *client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, c)
+}
+
+// Whether user and pass match the proxy's credentials, compared in
+// constant time.
+func (s *Server) authorized(user, pass string) bool {
+	u := subtle.ConstantTimeCompare([]byte(user), []byte(s.user))
+	p := subtle.ConstantTimeCompare([]byte(pass), []byte(s.pass))
+	return u&p == 1
+}
+
+// Prompt for credentials as the repeater does.
+func (c *client) login() bool {
+	c.nc.SetReadDeadline(time.Now().Add(loginTimeout))
+	defer c.nc.SetReadDeadline(time.Time{})
+
+	for i := 0; i < loginAttempts; i++ {
+		if c.write("login: ") != nil {
+			return false
+		}
+		user, err := c.readLine()
+		if err != nil {
+			return false
+		}
+		if c.write("password: ") != nil {
+			return false
+		}
+		pass, err := c.readLine()
+		if err != nil {
+			return false
+		}
+		if c.s.authorized(user, pass) {
+			return c.write("\r\n"+prompt) == nil
+		}
+		c.log.Warn("proxy login failed", "user", user)
+		if c.write("bad login\r\n") != nil {
+			return false
+		}
+	}
+	return false
+}
+
+// Handle commands from the client until it disconnects.
+func (c *client) serve() error {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if line != "" {
+			if err := c.command(line); err != nil {
+				return err
+			}
+		}
+
+		c.mu.Lock()
+		p := c.prompt
+		c.mu.Unlock()
+		if p {
+			if err := c.write(prompt); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *client) command(line string) error {
+	n := strings.Split(line, ",")
+	switch strings.ToUpper(n[0]) {
+	case "#MONITORING":
+		c.monitoring(n[1:])
+		return nil
+	case "?OUTPUT":
+		if reply, ok := c.cachedLevel(n[1:]); ok {
+			return c.writeLine(reply)
+		}
+	case "?DEVICE":
+		if reply, ok := c.cachedLed(n[1:]); ok {
+			return c.writeLine(reply)
+		}
+	}
+
+	if !strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "?") {
+		return nil
+	}
+	if err := c.s.conn.Send(line); err != nil {
+		c.log.Warn("proxy command dropped", "line", line, "err", err)
+	}
+	return nil
+}
+
+// Event types selected by #MONITORING types.
+var monitoringTypes = map[string]lutron.EventType{
+	"3": lutron.ButtonEvents,
+	"4": lutron.LedEvents,
+	"5": lutron.OutputEvents,
+	"6": lutron.GroupEvents,
+}
+
+func (c *client) monitoring(args []string) {
+	if len(args) != 2 {
+		return
+	}
+	enable := args[1] == "1"
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if args[0] == "12" {
+		c.prompt = enable
+	} else if t, ok := monitoringTypes[args[0]]; ok {
+		if enable {
+			c.disabled &^= t
+		} else {
+			c.disabled |= t
+		}
+	}
+}
+
+// Reply to "?OUTPUT,id,1" from the level cache of a known output.
+func (c *client) cachedLevel(args []string) (string, bool) {
+	if len(args) != 2 || args[1] != "1" {
+		return "", false
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return "", false
+	}
+	d, ok := c.s.conn.KnownDimmer(id)
+	if !ok {
+		return "", false
+	}
+	l, stale, ok := d.CachedLevel()
+	if !ok || stale {
+		return "", false
+	}
+	return fmt.Sprintf("~OUTPUT,%d,1,%d.00", id, l), true
+}
+
+// Reply to "?DEVICE,id,component,9" for an LED of a known keypad from
+// the LED cache.
+func (c *client) cachedLed(args []string) (string, bool) {
+	if len(args) != 3 || args[2] != "9" {
+		return "", false
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return "", false
+	}
+	comp, err := strconv.Atoi(args[1])
+	if err != nil || comp < 81 || comp > 95 {
+		return "", false
+	}
+	k, ok := c.s.conn.KnownKeypad(id)
+	if !ok {
+		return "", false
+	}
+	state, stale, ok := k.Button(uint8(comp - 80)).CachedLed()
+	if !ok || stale {
+		return "", false
+	}
+	return fmt.Sprintf("~DEVICE,%d,%d,9,%d", id, comp, state), true
+}
+
+// Write events from the repeater to the client.
+func (c *client) forward(events chan lutron.Event, done chan struct{}) {
+	for {
+		select {
+		case e := <-events:
+			if !strings.HasPrefix(e.Raw(), "~") {
+				continue
+			}
+			c.mu.Lock()
+			skip := c.disabled&e.Type() != 0
+			c.mu.Unlock()
+			if skip {
+				continue
+			}
+			if err := c.writeLine(e.Raw()); err != nil {
+				c.nc.Close()
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (c *client) readLine() (string, error) {
+	s, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(s, " \t\r\n\x00"), nil
+}
+
+func (c *client) writeLine(s string) error {
+	return c.write(s + "\r\n")
+}
+
+func (c *client) write(s string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.nc.Write([]byte(s))
+	return err
+}
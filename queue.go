@@ -0,0 +1,241 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default maximum rate commands are written to the main repeater.
+	DefaultCommandRate = 20
+
+	// Default number of commands waiting to be written before
+	// Execute and Query return ErrQueueFull.
+	DefaultQueueLimit = 100
+)
+
+// Returned when the command queue is full, usually because commands are
+// being issued faster than the configured rate. See WithCommandRate.
+var ErrQueueFull = errors.New("lutron: command queue full")
+
+// Wait for the reply on a channel returned by methods such as
+// Dimmer.Fade, Switch.On or KeypadButton.Press, or until ctx is done.
+// ErrQueueFull is returned if the channel was closed without a reply
+// because the command could not be queued.
+func Wait(ctx context.Context, c chan uint8) (uint8, error) {
+	select {
+	case v, ok := <-c:
+		if !ok {
+			return 0, ErrQueueFull
+		}
+		return v, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Order in which queued commands are written to the main repeater.
+type priority int
+
+const (
+	priorityCommand    priority = iota // "#" actions requested by the user.
+	priorityQuery                      // "?" queries waited on by the user.
+	priorityBackground                 // Refresh of stale state.
+	numPriorities
+)
+
+type request struct {
+	cmd      string
+	priority priority
+	queued   time.Time
+	awaited  bool // A Dimmer waits for the level to be acknowledged.
+}
+
+// Set the maximum number of commands written to the main repeater per
+// second. The repeater silently drops commands if flooded. Defaults to
+// DefaultCommandRate; 0 disables rate limiting.
+func WithCommandRate(perSecond float64) Option {
+	return func(c *Conn) {
+		if perSecond > 0 {
+			c.queue.interval = time.Duration(float64(time.Second) / perSecond)
+		} else {
+			c.queue.interval = 0
+		}
+	}
+}
+
+// Set the maximum number of commands waiting to be written before
+// Execute and Query return ErrQueueFull. Defaults to DefaultQueueLimit.
+func WithQueueLimit(n int) Option {
+	return func(c *Conn) {
+		c.queue.limit = n
+	}
+}
+
+// Queue a raw integration protocol line, such as "?SYSTEM,1" or
+// "#OUTPUT,12,1,50". Replies are observed through Events. Lines starting
+// with "?" are queued as queries, all others as commands. ErrQueueFull
+// is returned if the line cannot be queued. Empty lines are rejected.
+func (c *Conn) Send(line string) error {
+	if strings.TrimSpace(line) == "" {
+		return errors.New("lutron: empty line")
+	}
+	p := priorityCommand
+	if strings.HasPrefix(line, "?") {
+		p = priorityQuery
+	}
+	return c.queue.push(request{cmd: line, priority: p, queued: time.Now()})
+}
+
+// Number of commands waiting to be written to the main repeater.
+func (c *Conn) QueueLength() int {
+	return c.queue.length()
+}
+
+// Commands waiting to be written by the controller, ordered by priority
+// and then by arrival.
+type queue struct {
+	interval time.Duration
+	limit    int
+	ready    chan struct{}
+
+	mu    sync.Mutex
+	items [numPriorities][]request
+	size  int
+}
+
+func newQueue() *queue {
+	return &queue{
+		interval: time.Second / DefaultCommandRate,
+		limit:    DefaultQueueLimit,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// Add requests to the queue without blocking. Either all requests are
+// queued or none are. A "#OUTPUT,<id>,1,..." level command replaces any
+// level command for the same output that is still waiting, including
+// earlier ones in rs, as only the last level would be observed. Commands
+// whose acknowledgement a Dimmer awaits are never replaced.
+func (q *queue) push(rs ...request) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	last := make(map[string]int)
+	for i, r := range rs {
+		if key := outputLevelKey(r.cmd); key != "" {
+			last[key] = i
+		}
+	}
+	batch := make([]request, 0, len(rs))
+	for i, r := range rs {
+		key := outputLevelKey(r.cmd)
+		if key != "" && last[key] != i && !r.awaited {
+			continue
+		}
+		batch = append(batch, r)
+	}
+
+	replaced := 0
+	for p := range q.items {
+		for _, o := range q.items[p] {
+			if replaces(o, last) {
+				replaced++
+			}
+		}
+	}
+	if q.size-replaced+len(batch) > q.limit {
+		return ErrQueueFull
+	}
+
+	if replaced > 0 {
+		for p := range q.items {
+			kept := q.items[p][:0]
+			for _, o := range q.items[p] {
+				if !replaces(o, last) {
+					kept = append(kept, o)
+				}
+			}
+			q.items[p] = kept
+		}
+		q.size -= replaced
+	}
+	for _, r := range batch {
+		q.items[r.priority] = append(q.items[r.priority], r)
+		q.size++
+	}
+	q.wake()
+	return nil
+}
+
+// Whether waiting request o is replaced by a level command whose key is
+// in keys.
+func replaces(o request, keys map[string]int) bool {
+	if o.awaited {
+		return false
+	}
+	key := outputLevelKey(o.cmd)
+	if key == "" {
+		return false
+	}
+	_, ok := keys[key]
+	return ok
+}
+
+// Remove the highest priority request.
+func (q *queue) pop() (request, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for p, items := range q.items {
+		if len(items) > 0 {
+			r := items[0]
+			q.items[p] = items[1:]
+			q.size--
+			return r, true
+		}
+	}
+	return request{}, false
+}
+
+// Time to wait before retrying a request rejected with ErrQueueFull.
+func (q *queue) retryDelay() time.Duration {
+	if q.interval > 0 {
+		return q.interval
+	}
+	return 10 * time.Millisecond
+}
+
+func (q *queue) length() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// Wake the controller to write the next request.
+func (q *queue) wake() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Returns "OUTPUT,<id>" for "#OUTPUT,<id>,1,..." level commands.
+func outputLevelKey(cmd string) string {
+	if !strings.HasPrefix(cmd, "#OUTPUT,") {
+		return ""
+	}
+	n := strings.SplitN(cmd[1:], ",", 4)
+	if len(n) < 4 || n[2] != "1" {
+		return ""
+	}
+	return n[0] + "," + n[1]
+}
@@ -0,0 +1,122 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"strings"
+	"testing"
+)
+
+// Commands left in q, in the order they would be written.
+func drain(q *queue) string {
+	var r []string
+	for {
+		req, ok := q.pop()
+		if !ok {
+			return strings.Join(r, " ")
+		}
+		r = append(r, req.cmd)
+	}
+}
+
+func TestQueuePriority(t *testing.T) {
+	q := newQueue()
+	for _, r := range []request{
+		{cmd: "?OUTPUT,1,1", priority: priorityBackground},
+		{cmd: "?OUTPUT,2,1", priority: priorityQuery},
+		{cmd: "#DEVICE,3,1,3", priority: priorityCommand},
+		{cmd: "?OUTPUT,4,1", priority: priorityBackground},
+		{cmd: "#DEVICE,3,1,4", priority: priorityCommand},
+	} {
+		if err := q.push(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := q.length(); n != 5 {
+		t.Errorf("length() = %d, want 5", n)
+	}
+	want := "#DEVICE,3,1,3 #DEVICE,3,1,4 ?OUTPUT,2,1 ?OUTPUT,1,1 ?OUTPUT,4,1"
+	if got := drain(q); got != want {
+		t.Errorf("queue = %q, want %q", got, want)
+	}
+	if n := q.length(); n != 0 {
+		t.Errorf("length() = %d after draining", n)
+	}
+}
+
+func TestQueueCoalesce(t *testing.T) {
+	cmd := func(s string) request { return request{cmd: s} }
+	awaited := func(s string) request { return request{cmd: s, awaited: true} }
+
+	for _, tc := range []struct {
+		name   string
+		pushes [][]request
+		want   string
+	}{
+		{"replaces waiting level",
+			[][]request{{cmd("#OUTPUT,1,1,50")}, {cmd("#OUTPUT,1,1,60")}},
+			"#OUTPUT,1,1,60"},
+		{"other outputs kept",
+			[][]request{{cmd("#OUTPUT,1,1,50")}, {cmd("#OUTPUT,2,1,60")}},
+			"#OUTPUT,1,1,50 #OUTPUT,2,1,60"},
+		{"other actions kept",
+			[][]request{{cmd("#OUTPUT,1,2")}, {cmd("#OUTPUT,1,1,60")}, {cmd("#OUTPUT,1,3")}},
+			"#OUTPUT,1,2 #OUTPUT,1,1,60 #OUTPUT,1,3"},
+		{"within a batch",
+			[][]request{{cmd("#OUTPUT,1,1,50"), cmd("#OUTPUT,2,1,10"), cmd("#OUTPUT,1,1,60")}},
+			"#OUTPUT,2,1,10 #OUTPUT,1,1,60"},
+		{"awaited kept",
+			[][]request{{awaited("#OUTPUT,1,1,50")}, {cmd("#OUTPUT,1,1,60")}},
+			"#OUTPUT,1,1,50 #OUTPUT,1,1,60"},
+		{"awaited replaces",
+			[][]request{{cmd("#OUTPUT,1,1,50")}, {awaited("#OUTPUT,1,1,60")}},
+			"#OUTPUT,1,1,60"},
+		{"awaited within a batch",
+			[][]request{{awaited("#OUTPUT,1,1,50"), cmd("#OUTPUT,1,1,60")}},
+			"#OUTPUT,1,1,50 #OUTPUT,1,1,60"},
+	} {
+		q := newQueue()
+		for _, rs := range tc.pushes {
+			if err := q.push(rs...); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+		}
+		if got := drain(q); got != tc.want {
+			t.Errorf("%s: queue = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	q := newQueue()
+	q.limit = 2
+	cmd := func(s string) request { return request{cmd: s} }
+
+	if err := q.push(cmd("#DEVICE,3,1,3"), cmd("#OUTPUT,1,1,50")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.push(cmd("#DEVICE,3,1,4")); err != ErrQueueFull {
+		t.Errorf("push to full queue = %v, want ErrQueueFull", err)
+	}
+	if err := q.push(cmd("#DEVICE,3,1,4"), cmd("#DEVICE,3,1,3")); err != ErrQueueFull {
+		t.Errorf("push of batch = %v, want ErrQueueFull", err)
+	}
+	if err := q.push(cmd("#OUTPUT,1,1,60")); err != nil {
+		t.Errorf("push replacing a waiting level = %v", err)
+	}
+	if got, want := drain(q), "#DEVICE,3,1,3 #OUTPUT,1,1,60"; got != want {
+		t.Errorf("queue = %q, want %q", got, want)
+	}
+
+	// An awaited level is never replaced, so it cannot make room.
+	q.limit = 1
+	if err := q.push(request{cmd: "#OUTPUT,1,1,70", awaited: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.push(cmd("#OUTPUT,1,1,80")); err != ErrQueueFull {
+		t.Errorf("push replacing an awaited level = %v, want ErrQueueFull", err)
+	}
+}
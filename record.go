@@ -0,0 +1,173 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One line of a recorded session, stored as a JSON object per line.
+type RecordedLine struct {
+	Time time.Time `json:"time"`
+	Dir  string    `json:"dir"` // "rx" from the repeater, "tx" to it.
+	Line string    `json:"line"`
+}
+
+// Writes every line received from and sent to the main repeater, with
+// timestamps, as JSON lines. Recordings can be played back with Replay
+// to reproduce a problem without access to the repeater.
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// Create a recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Record the session to r. The recording continues across reconnects.
+func WithRecorder(r *Recorder) Option {
+	return func(c *Conn) {
+		c.recorder = r
+	}
+}
+
+// First error encountered writing the recording, if any.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(dir, line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err == nil {
+		r.err = r.enc.Encode(&RecordedLine{time.Now(), dir, line})
+	}
+}
+
+type recordingTransport struct {
+	Transport
+	r *Recorder
+}
+
+func (t *recordingTransport) ReadLine() (string, error) {
+	s, err := t.Transport.ReadLine()
+	if err == nil {
+		t.r.record("rx", strings.TrimSpace(s))
+	}
+	return s, err
+}
+
+func (t *recordingTransport) WriteLine(s string) error {
+	t.r.record("tx", s)
+	return t.Transport.WriteLine(s)
+}
+
+// Transport playing back a session recorded by Recorder. Received lines
+// are delivered with their original spacing divided by the speed factor;
+// commands written to the replay are collected but otherwise ignored.
+// ReadLine returns io.EOF after the last recorded line.
+type Replay struct {
+	lines []RecordedLine
+	speed float64
+	done  chan struct{}
+
+	mu      sync.Mutex
+	next    int
+	last    time.Time
+	written []string
+	closed  bool
+}
+
+// Read a recording for replay. speed 1 reproduces the original timing,
+// 10 plays ten times faster, and 0 delivers lines without delay.
+func NewReplay(r io.Reader, speed float64) (*Replay, error) {
+	p := &Replay{speed: speed, done: make(chan struct{})}
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for n := 1; s.Scan(); n++ {
+		if len(strings.TrimSpace(s.Text())) == 0 {
+			continue
+		}
+		var l RecordedLine
+		if err := json.Unmarshal(s.Bytes(), &l); err != nil {
+			return nil, fmt.Errorf("lutron: recording line %d: %v", n, err)
+		}
+		if l.Dir == "rx" {
+			p.lines = append(p.lines, l)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Replay) ReadLine() (string, error) {
+	p.mu.Lock()
+	if p.closed || p.next >= len(p.lines) {
+		p.mu.Unlock()
+		return "", io.EOF
+	}
+	l := p.lines[p.next]
+	p.next++
+
+	var delay time.Duration
+	if p.speed > 0 && !p.last.IsZero() {
+		delay = time.Duration(float64(l.Time.Sub(p.last)) / p.speed)
+	}
+	p.last = l.Time
+	p.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-p.done:
+			return "", io.EOF
+		}
+	}
+	return l.Line, nil
+}
+
+func (p *Replay) WriteLine(s string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return io.ErrClosedPipe
+	}
+	p.written = append(p.written, s)
+	return nil
+}
+
+func (p *Replay) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+	return nil
+}
+
+// Commands written to the replay by the connection, in order.
+func (p *Replay) Written() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.written...)
+}
@@ -0,0 +1,170 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Transport standing in for a main repeater that answers output level
+// queries with 45%.
+type scriptedTransport struct {
+	lines  chan string
+	closed chan struct{}
+}
+
+func newScriptedTransport() *scriptedTransport {
+	return &scriptedTransport{lines: make(chan string, 16), closed: make(chan struct{})}
+}
+
+func (t *scriptedTransport) ReadLine() (string, error) {
+	select {
+	case l := <-t.lines:
+		return l, nil
+	case <-t.closed:
+		return "", io.EOF
+	}
+}
+
+func (t *scriptedTransport) WriteLine(s string) error {
+	if strings.HasPrefix(s, "?OUTPUT,") {
+		t.lines <- "~" + s[1:] + ",45.00\r\n"
+	}
+	return nil
+}
+
+func (t *scriptedTransport) Close() error {
+	select {
+	case <-t.closed:
+	default:
+		close(t.closed)
+	}
+	return nil
+}
+
+func level(t *testing.T, d *Dimmer) uint8 {
+	t.Helper()
+	select {
+	case l, ok := <-d.Level():
+		if !ok {
+			t.Fatal("level query not queued")
+		}
+		return l
+	case <-time.After(5 * time.Second):
+		t.Fatal("no level reported")
+	}
+	return 0
+}
+
+func TestRecordReplay(t *testing.T) {
+	var buf bytes.Buffer
+	rec := NewRecorder(&buf)
+	conn, err := NewConn(newScriptedTransport(), WithRecorder(rec), WithCommandRate(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := level(t, conn.Dimmer(12)); l != 45 {
+		t.Errorf("recorded level = %d, want 45", l)
+	}
+	conn.Close()
+	if err := rec.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var tx, rx []string
+	for _, s := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var l RecordedLine
+		if err := json.Unmarshal([]byte(s), &l); err != nil {
+			t.Fatalf("recording %q: %v", s, err)
+		}
+		if l.Time.IsZero() {
+			t.Errorf("recording %q has no time", s)
+		}
+		switch l.Dir {
+		case "tx":
+			tx = append(tx, l.Line)
+		case "rx":
+			rx = append(rx, l.Line)
+		default:
+			t.Errorf("recording %q has direction %q", s, l.Dir)
+		}
+	}
+	if len(tx) == 0 || tx[0] != "#MONITORING,1,2" || tx[len(tx)-1] != "?OUTPUT,12,1" {
+		t.Errorf("recorded tx %q", tx)
+	}
+	if want := []string{"~OUTPUT,12,1,45.00"}; strings.Join(rx, " ") != strings.Join(want, " ") {
+		t.Errorf("recorded rx %q, want %q", rx, want)
+	}
+
+	p, err := NewReplay(bytes.NewReader(buf.Bytes()), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = NewConn(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if l := level(t, conn.Dimmer(12)); l != 45 {
+		t.Errorf("replayed level = %d, want 45", l)
+	}
+	if w := p.Written(); len(w) < 5 || strings.Join(w[:5], " ") != strings.Join(tx[:5], " ") {
+		t.Errorf("replay written %q, recorded %q", w, tx)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, l := range []RecordedLine{
+		{start, "tx", "#MONITORING,1,2"},
+		{start, "rx", "~OUTPUT,1,1,10.00"},
+		{start.Add(time.Second), "rx", "~OUTPUT,1,1,20.00"},
+	} {
+		enc.Encode(&l)
+	}
+	buf.WriteString("\n")
+
+	p, err := NewReplay(&buf, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := p.ReadLine(); l != "~OUTPUT,1,1,10.00" || err != nil {
+		t.Errorf("ReadLine() = %q, %v", l, err)
+	}
+	began := time.Now()
+	if l, err := p.ReadLine(); l != "~OUTPUT,1,1,20.00" || err != nil {
+		t.Errorf("ReadLine() = %q, %v", l, err)
+	}
+	if d := time.Since(began); d < 100*time.Millisecond || d > time.Second {
+		t.Errorf("line delivered after %v at 10x speed, want 100ms", d)
+	}
+	if _, err := p.ReadLine(); err != io.EOF {
+		t.Errorf("ReadLine() after last line = %v, want io.EOF", err)
+	}
+
+	if err := p.WriteLine("?OUTPUT,1,1"); err != nil {
+		t.Error(err)
+	}
+	p.Close()
+	if err := p.WriteLine("?OUTPUT,1,1"); err != io.ErrClosedPipe {
+		t.Errorf("WriteLine() after Close = %v, want io.ErrClosedPipe", err)
+	}
+	if w := p.Written(); len(w) != 1 || w[0] != "?OUTPUT,1,1" {
+		t.Errorf("Written() = %q", w)
+	}
+
+	if _, err := NewReplay(strings.NewReader("{}\nnot json\n"), 0); err == nil ||
+		!strings.Contains(err.Error(), "line 2") {
+		t.Errorf("NewReplay of invalid recording = %v, want line 2 error", err)
+	}
+}
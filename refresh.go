@@ -0,0 +1,194 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Objects that did not reply to Conn.Refresh.
+type RefreshReport struct {
+	// Number of queries sent.
+	Queried int
+
+	// Integration ids of dimmers that did not reply.
+	Dimmers []int
+
+	// Monitored keypad LEDs that did not reply.
+	Leds []*KeypadButton
+}
+
+// True if every object replied.
+func (r *RefreshReport) Complete() bool {
+	return len(r.Dimmers) == 0 && len(r.Leds) == 0
+}
+
+// Query every known dimmer and every monitored keypad LED, waiting for
+// all replies until ctx is done. Objects that did not reply before the
+// deadline are listed in the report; they may be offline, or their
+// integration ids may have been entered incorrectly. Their unanswered
+// queries are abandoned, so later reads query them again.
+//
+// Queries are sent at background priority, behind commands and other
+// queries, and are paced to fit in the command queue. Monitors observe
+// any level or LED changes discovered by the refresh.
+func (c *Conn) Refresh(ctx context.Context) (*RefreshReport, error) {
+	type wait struct {
+		dimmer *Dimmer
+		led    *KeypadButton
+		reply  chan uint8
+	}
+
+	var waits []wait
+	for _, d := range c.Dimmers() {
+		r, err := c.retryFull(ctx, func() (chan uint8, error) {
+			return d.readLevelAt(priorityBackground)
+		})
+		if err != nil {
+			return nil, err
+		}
+		waits = append(waits, wait{dimmer: d, reply: r})
+	}
+	for _, k := range c.Keypads() {
+		for _, id := range k.monitoredLeds() {
+			b := k.Button(id)
+			r, err := c.retryFull(ctx, func() (chan uint8, error) {
+				return b.readLedAt(priorityBackground)
+			})
+			if err != nil {
+				return nil, err
+			}
+			waits = append(waits, wait{led: b, reply: r})
+		}
+	}
+
+	report := &RefreshReport{Queried: len(waits)}
+	for _, w := range waits {
+		select {
+		case <-w.reply:
+			continue
+		case <-ctx.Done():
+		}
+
+		// Deadline passed; collect replies already received.
+		select {
+		case <-w.reply:
+		default:
+			if w.dimmer != nil {
+				w.dimmer.abandonRead(w.reply)
+				report.Dimmers = append(report.Dimmers, w.dimmer.id)
+			} else {
+				w.led.abandonRead(w.reply)
+				report.Leds = append(report.Leds, w.led)
+			}
+		}
+	}
+	sort.Ints(report.Dimmers)
+	return report, nil
+}
+
+// Retry a query while the command queue is full, until ctx is done.
+func (c *Conn) retryFull(ctx context.Context, query func() (chan uint8, error)) (chan uint8, error) {
+	for {
+		r, err := query()
+		if err != ErrQueueFull {
+			return r, err
+		}
+		select {
+		case <-time.After(c.queue.retryDelay()):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Query the level, even if a query is already outstanding as its reply
+// may have been lost, and send it once on the returned channel.
+func (d *Dimmer) readLevelAt(p priority) (chan uint8, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.send('?', "1", p); err != nil {
+		return nil, err
+	}
+	d.querying = true
+	w := make(chan uint8, 1)
+	d.readers = append(d.readers, w)
+	return w, nil
+}
+
+// Stop waiting for a reply to a query made by readLevelAt. The query is
+// presumed lost, so the next read sends another.
+func (d *Dimmer) abandonRead(w chan uint8) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, r := range d.readers {
+		if r == w {
+			d.readers = append(d.readers[:i], d.readers[i+1:]...)
+			break
+		}
+	}
+	d.querying = false
+}
+
+// Get the state of the button's LED directly from the main repeater and
+// send it once on the returned channel. The channel is closed without
+// a value if the query cannot be queued.
+func (b *KeypadButton) ReadLed() chan uint8 {
+	r, err := b.readLedAt(priorityQuery)
+	if err != nil {
+		r = make(chan uint8)
+		close(r)
+	}
+	return r
+}
+
+func (b *KeypadButton) readLedAt(p priority) (chan uint8, error) {
+	k := b.k
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.send('?', fmt.Sprintf("%d,9", 80+b.id), p); err != nil {
+		return nil, err
+	}
+	m := keypadMonitor{id: b.id, signal: make(chan uint8, 1)}
+	k.ledReaders = append(k.ledReaders, m)
+	return m.signal, nil
+}
+
+// Stop waiting for a reply to a query made by readLedAt.
+func (b *KeypadButton) abandonRead(w chan uint8) {
+	k := b.k
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for i, r := range k.ledReaders {
+		if r.signal == w {
+			k.ledReaders = append(k.ledReaders[:i], k.ledReaders[i+1:]...)
+			break
+		}
+	}
+}
+
+// Ids of LEDs with at least one monitor.
+func (k *Keypad) monitoredLeds() []uint8 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var r []uint8
+	seen := 0
+	for _, l := range k.leds {
+		if m := 1 << l.id; seen&m == 0 {
+			seen |= m
+			r = append(r, l.id)
+		}
+	}
+	return r
+}
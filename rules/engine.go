@@ -0,0 +1,655 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spearce/lutron"
+	"gopkg.in/yaml.v2"
+)
+
+// Time allowed for each action of a rule, such as a repeater command or
+// a webhook, to complete.
+const actionTimeout = 10 * time.Second
+
+// Runs rules against a connection.
+type Engine struct {
+	// Logger recording each firing; slog.Default() if nil.
+	Logger *slog.Logger
+
+	// Client for webhooks; http.DefaultClient if nil.
+	Client *http.Client
+
+	conn   *lutron.Conn
+	reload chan struct{}
+
+	mu     sync.Mutex
+	rules  []*compiled
+	groups map[string]*lutron.LedGroup
+}
+
+// Create an engine for conn with no rules.
+func New(conn *lutron.Conn) *Engine {
+	return &Engine{
+		conn:   conn,
+		reload: make(chan struct{}, 1),
+		groups: make(map[string]*lutron.LedGroup),
+	}
+}
+
+// Make a group available to select actions under name. Groups must be
+// added before rules referring to them are loaded.
+func (e *Engine) AddLedGroup(name string, g *lutron.LedGroup) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.groups[name] = g
+}
+
+// Replace the engine's rules. If any rule is invalid an error is
+// returned and the current rules are kept.
+func (e *Engine) Load(rules []*Rule) error {
+	var c []*compiled
+	for i, r := range rules {
+		cr, err := e.compile(r)
+		if err != nil {
+			release(c)
+			name := r.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return fmt.Errorf("rules: rule %s: %v", name, err)
+		}
+		c = append(c, cr)
+	}
+
+	e.mu.Lock()
+	old := e.rules
+	e.rules = c
+	e.mu.Unlock()
+	release(old)
+
+	select {
+	case e.reload <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Read a YAML (.yaml, .yml) or JSON rules file and Load its rules.
+func (e *Engine) LoadFile(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var f File
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, &f)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	}
+	if err != nil {
+		return fmt.Errorf("rules: %s: %v", file, err)
+	}
+	return e.Load(f.Rules)
+}
+
+// Load rules from file, then reload them whenever the file changes,
+// checking every interval until ctx is done. Only the first load's error
+// is returned; later errors are logged and the previous rules kept.
+func (e *Engine) Watch(ctx context.Context, file string, interval time.Duration) error {
+	st, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if err := e.LoadFile(file); err != nil {
+		return err
+	}
+	e.logger().Info("rules loaded", "file", file, "rules", e.count())
+
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		mod := st.ModTime()
+		for {
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+			st, err := os.Stat(file)
+			if err != nil || st.ModTime().Equal(mod) {
+				continue
+			}
+			mod = st.ModTime()
+			if err := e.LoadFile(file); err != nil {
+				e.logger().Error("rules reload failed", "file", file, "err", err)
+				continue
+			}
+			e.logger().Info("rules reloaded", "file", file, "rules", e.count())
+		}
+	}()
+	return nil
+}
+
+func (e *Engine) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.rules)
+}
+
+func (e *Engine) current() []*compiled {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rules
+}
+
+func (e *Engine) logger() *slog.Logger {
+	if e.Logger != nil {
+		return e.Logger
+	}
+	return slog.Default()
+}
+
+// Pending hold trigger, fired unless the button is released first.
+type hold struct {
+	rule  *compiled
+	timer *time.Timer
+}
+
+// Process events and fire rules until ctx is done.
+func (e *Engine) Run(ctx context.Context) error {
+	events := make(chan lutron.Event)
+	sub := e.conn.SubscribeEvents(events, lutron.EventFilter{
+		Types: lutron.OutputEvents | lutron.ButtonEvents | lutron.LedEvents,
+	}, lutron.MonitorOptions{Buffer: 64, Overflow: lutron.DropOldest})
+	defer sub.Unsubscribe()
+
+	levels := make(map[int]float64)
+	for _, d := range e.conn.Dimmers() {
+		if l, stale, ok := d.CachedLevel(); ok && !stale {
+			levels[d.Id()] = float64(l)
+		}
+	}
+
+	holds := make(map[*compiled]*hold)
+	held := make(chan *hold)
+	defer func() {
+		for _, h := range holds {
+			h.timer.Stop()
+		}
+	}()
+
+	last := time.Now()
+	clock := time.NewTimer(e.nextAt(last).Sub(last))
+	defer clock.Stop()
+
+	for {
+		select {
+		case ev := <-events:
+			switch ev := ev.(type) {
+			case *lutron.ButtonEvent:
+				for _, r := range e.current() {
+					if !r.trigger.button(ev) {
+						continue
+					}
+					switch {
+					case r.trigger.event == "hold" && ev.Action == lutron.ButtonPress:
+						h := &hold{rule: r}
+						h.timer = time.AfterFunc(r.trigger.hold, func() {
+							select {
+							case held <- h:
+							case <-ctx.Done():
+							}
+						})
+						holds[r] = h
+					case r.trigger.event == "hold" && ev.Action == lutron.ButtonRelease:
+						if h := holds[r]; h != nil {
+							h.timer.Stop()
+							delete(holds, r)
+						}
+					case r.trigger.action == ev.Action:
+						e.fire(ctx, r, ev.Raw())
+					}
+				}
+
+			case *lutron.LedEvent:
+				for _, r := range e.current() {
+					if r.trigger.led(ev) {
+						e.fire(ctx, r, ev.Raw())
+					}
+				}
+
+			case *lutron.OutputLevelEvent:
+				prev, ok := levels[ev.Id()]
+				levels[ev.Id()] = ev.Level
+				if !ok {
+					break
+				}
+				for _, r := range e.current() {
+					if r.trigger.crossed(ev.Id(), prev, ev.Level) {
+						e.fire(ctx, r, ev.Raw())
+					}
+				}
+			}
+
+		case h := <-held:
+			if holds[h.rule] == h {
+				delete(holds, h.rule)
+				if e.loaded(h.rule) {
+					e.fire(ctx, h.rule, fmt.Sprintf("held %v", h.rule.trigger.hold))
+				}
+			}
+
+		case now := <-clock.C:
+			for _, r := range e.current() {
+				if r.trigger.at >= 0 && !r.trigger.next(last).After(now) {
+					e.fire(ctx, r, "at "+r.rule.Trigger.At)
+				}
+			}
+			last = now
+			clock.Reset(e.nextAt(now).Sub(time.Now()))
+
+		case <-e.reload:
+			if !clock.Stop() {
+				select {
+				case <-clock.C:
+				default:
+				}
+			}
+			clock.Reset(e.nextAt(last).Sub(time.Now()))
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Earliest time trigger after t, or a day later if there are none.
+func (e *Engine) nextAt(t time.Time) time.Time {
+	next := t.Add(24 * time.Hour)
+	for _, r := range e.current() {
+		if r.trigger.at >= 0 {
+			if n := r.trigger.next(t); n.Before(next) {
+				next = n
+			}
+		}
+	}
+	return next
+}
+
+func (e *Engine) loaded(r *compiled) bool {
+	for _, c := range e.current() {
+		if c == r {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a rule's conditions and run its actions in a new goroutine.
+func (e *Engine) fire(ctx context.Context, r *compiled, cause string) {
+	log := e.logger().With("rule", r.rule.Name)
+	for _, c := range r.conditions {
+		if ok, desc := c(); !ok {
+			log.Debug("rule condition not met", "trigger", cause, "condition", desc)
+			return
+		}
+	}
+	log.Info("rule fired", "trigger", cause)
+
+	go func() {
+		for i, a := range r.actions {
+			actx, cancel := context.WithTimeout(ctx, actionTimeout)
+			err := a(actx)
+			cancel()
+			if err != nil {
+				log.Warn("rule action failed", "action", i+1, "err", err)
+			}
+		}
+	}()
+}
+
+type compiled struct {
+	rule       *Rule
+	trigger    trigger
+	conditions []func() (bool, string)
+	actions    []func(context.Context) error
+
+	// Monitors keeping the state of LEDs in conditions known.
+	subs []*lutron.Subscription
+}
+
+// Stop the monitors of rules that are no longer loaded.
+func release(rules []*compiled) {
+	for _, r := range rules {
+		for _, s := range r.subs {
+			s.Unsubscribe()
+		}
+	}
+}
+
+// Trigger with names resolved.
+type trigger struct {
+	keypad int
+	btn    uint8
+	event  string
+	action uint8
+	hold   time.Duration
+
+	ledState int // -1 for any state.
+
+	output int
+	above  *float64
+	below  *float64
+
+	at int // Minutes after midnight, -1 if not a time trigger.
+}
+
+func (t *trigger) button(ev *lutron.ButtonEvent) bool {
+	return t.event != "" && ev.Id() == t.keypad && ev.Button == t.btn
+}
+
+func (t *trigger) led(ev *lutron.LedEvent) bool {
+	return t.event == "" && t.btn != 0 && ev.Id() == t.keypad && ev.Button == t.btn &&
+		(t.ledState < 0 || int(ev.State) == t.ledState)
+}
+
+func (t *trigger) crossed(id int, prev, level float64) bool {
+	if t.output == 0 || id != t.output {
+		return false
+	}
+	return (t.above != nil && prev <= *t.above && level > *t.above) ||
+		(t.below != nil && prev >= *t.below && level < *t.below)
+}
+
+// First time of day for the trigger after t.
+func (t *trigger) next(after time.Time) time.Time {
+	y, m, d := after.Date()
+	n := time.Date(y, m, d, t.at/60, t.at%60, 0, 0, after.Location())
+	if !n.After(after) {
+		n = time.Date(y, m, d+1, t.at/60, t.at%60, 0, 0, after.Location())
+	}
+	return n
+}
+
+func (e *Engine) compile(r *Rule) (*compiled, error) {
+	c := &compiled{rule: r, trigger: trigger{at: -1}}
+	t := &r.Trigger
+
+	set := 0
+	for _, s := range []string{t.Button, t.Led, t.Output, t.At} {
+		if s != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("trigger needs exactly one of button, led, output or at")
+	}
+
+	switch {
+	case t.Button != "":
+		b, err := e.button(t.Button)
+		if err != nil {
+			return nil, err
+		}
+		c.trigger.keypad, c.trigger.btn = b.Keypad().Id(), b.Id()
+		c.trigger.event = t.Event
+		switch t.Event {
+		case "", "press":
+			c.trigger.event, c.trigger.action = "press", lutron.ButtonPress
+		case "release":
+			c.trigger.action = lutron.ButtonRelease
+		case "hold":
+			c.trigger.hold = time.Duration(t.Hold)
+			if c.trigger.hold <= 0 {
+				c.trigger.hold = DefaultHold
+			}
+		default:
+			return nil, fmt.Errorf("unknown button event %q", t.Event)
+		}
+
+	case t.Led != "":
+		b, err := e.button(t.Led)
+		if err != nil {
+			return nil, err
+		}
+		c.trigger.keypad, c.trigger.btn = b.Keypad().Id(), b.Id()
+		c.trigger.ledState = -1
+		if t.State != "" {
+			s, err := ledState(t.State)
+			if err != nil {
+				return nil, err
+			}
+			c.trigger.ledState = int(s)
+		}
+
+	case t.Output != "":
+		d, err := e.output(t.Output)
+		if err != nil {
+			return nil, err
+		}
+		if t.Above == nil && t.Below == nil {
+			return nil, errors.New("output trigger needs above or below")
+		}
+		c.trigger.output, c.trigger.above, c.trigger.below = d.Id(), t.Above, t.Below
+
+	case t.At != "":
+		at, err := time.Parse("15:04", t.At)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q", t.At)
+		}
+		c.trigger.at = at.Hour()*60 + at.Minute()
+	}
+
+	for _, cond := range r.Conditions {
+		f, err := e.condition(c, cond)
+		if err != nil {
+			release([]*compiled{c})
+			return nil, err
+		}
+		c.conditions = append(c.conditions, f)
+	}
+	for _, a := range r.Actions {
+		f, err := e.action(a)
+		if err != nil {
+			release([]*compiled{c})
+			return nil, err
+		}
+		c.actions = append(c.actions, f)
+	}
+	return c, nil
+}
+
+// Compile a condition of rule r. The state it tests is queried now, and
+// LEDs are monitored until r is released, so it is known when r fires.
+// States loaded from the state file are treated as unknown.
+func (e *Engine) condition(r *compiled, c Condition) (func() (bool, string), error) {
+	switch {
+	case c.Output != "" && c.Led == "":
+		d, err := e.output(c.Output)
+		if err != nil {
+			return nil, err
+		}
+		d.Level()
+		return func() (bool, string) {
+			l, stale, ok := d.CachedLevel()
+			if !ok || stale {
+				return false, c.Output + " level unknown"
+			}
+			v := float64(l)
+			desc := fmt.Sprintf("%s at %d%%", c.Output, l)
+			return (c.Above == nil || v > *c.Above) && (c.Below == nil || v < *c.Below), desc
+		}, nil
+
+	case c.Led != "" && c.Output == "":
+		b, err := e.button(c.Led)
+		if err != nil {
+			return nil, err
+		}
+		want, err := ledState(c.State)
+		if err != nil {
+			return nil, err
+		}
+		// Nothing receives from the monitor; it only keeps the LED
+		// monitored, and its delivery stays blocked until released.
+		r.subs = append(r.subs, b.SubscribeLed(make(chan uint8),
+			lutron.MonitorOptions{Buffer: 1, Overflow: lutron.DropOldest},
+			lutron.LedOff, lutron.LedOn, lutron.LedNormalFlash, lutron.LedRapidFlash))
+		return func() (bool, string) {
+			s, stale, ok := b.CachedLed()
+			if !ok || stale {
+				return false, c.Led + " LED unknown"
+			}
+			return s == want, fmt.Sprintf("%s LED %d", c.Led, s)
+		}, nil
+	}
+	return nil, errors.New("condition needs exactly one of output or led")
+}
+
+func (e *Engine) action(a Action) (func(context.Context) error, error) {
+	switch {
+	case a.Fade != nil:
+		d, err := e.output(a.Fade.Output)
+		if err != nil {
+			return nil, err
+		}
+		if a.Fade.Level > 100 {
+			return nil, fmt.Errorf("level %d out of range", a.Fade.Level)
+		}
+		return func(ctx context.Context) error {
+			fade := d.DefaultFade()
+			if a.Fade.Fade != nil {
+				fade = time.Duration(*a.Fade.Fade)
+			}
+			_, err := lutron.Wait(ctx, d.Fade(a.Fade.Level, fade))
+			return err
+		}, nil
+
+	case a.Press != "":
+		b, err := e.button(a.Press)
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) error {
+			_, err := lutron.Wait(ctx, b.Press())
+			return err
+		}, nil
+
+	case a.Select != nil:
+		e.mu.Lock()
+		g := e.groups[a.Select.Group]
+		e.mu.Unlock()
+		if g == nil {
+			return nil, fmt.Errorf("unknown LED group %q", a.Select.Group)
+		}
+		var sel *lutron.KeypadButton
+		if a.Select.Button != "" {
+			b, err := e.button(a.Select.Button)
+			if err != nil {
+				return nil, err
+			}
+			sel = b
+		}
+		return func(ctx context.Context) error {
+			return g.Select(sel).WaitContext(ctx)
+		}, nil
+
+	case a.Webhook != nil:
+		w := a.Webhook
+		if _, err := http.NewRequest(w.Method, w.URL, nil); err != nil || w.URL == "" {
+			return nil, fmt.Errorf("invalid webhook %q", w.URL)
+		}
+		return func(ctx context.Context) error {
+			return e.webhook(ctx, w)
+		}, nil
+	}
+	return nil, errors.New("action needs one of fade, press, select or webhook")
+}
+
+func (e *Engine) webhook(ctx context.Context, w *WebhookAction) error {
+	method := w.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, w.URL, strings.NewReader(w.Body))
+	if err != nil {
+		return err
+	}
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s: %s", w.URL, resp.Status)
+	}
+	return nil
+}
+
+// Find an output by name or integration id.
+func (e *Engine) output(ref string) (*lutron.Dimmer, error) {
+	if id, err := strconv.Atoi(ref); err == nil {
+		return e.conn.Dimmer(id), nil
+	}
+	return e.conn.LookupDimmer(ref)
+}
+
+// Find a button by name or as "keypad/button" integration ids.
+func (e *Engine) button(ref string) (*lutron.KeypadButton, error) {
+	b, err := e.conn.LookupButton(ref)
+	if err == nil {
+		return b, nil
+	}
+	if n := strings.Split(ref, "/"); len(n) == 2 {
+		k, err1 := strconv.Atoi(n[0])
+		c, err2 := strconv.ParseUint(n[1], 10, 8)
+		if err1 == nil && err2 == nil && 1 <= c && c <= 25 {
+			return e.conn.Keypad(k).Button(uint8(c)), nil
+		}
+	}
+	return nil, err
+}
+
+func ledState(s string) (uint8, error) {
+	switch strings.ToLower(s) {
+	case "off":
+		return lutron.LedOff, nil
+	case "on":
+		return lutron.LedOn, nil
+	case "flash":
+		return lutron.LedNormalFlash, nil
+	case "rapid":
+		return lutron.LedRapidFlash, nil
+	}
+	return 0, fmt.Errorf("invalid LED state %q", s)
+}
@@ -0,0 +1,255 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package rules runs declarative automation rules against a lutron
+connection, replacing ad hoc select loops over monitor channels.
+
+Each rule has a trigger, optional conditions that must all hold, and
+actions run in order. Rules are usually kept in a YAML or JSON file:
+
+  rules:
+  - name: goodnight
+    when: {button: Foyer/Goodnight, event: hold, hold: 2s}
+    if:
+    - {output: Kitchen/Island, above: 0}
+    then:
+    - fade: {output: Kitchen/Island, level: 0, fade: 10s}
+    - press: Foyer/All Off
+    - select: {group: scenes, button: Foyer/Evening}
+    - webhook: {url: "http://example.com/goodnight"}
+
+or built in Go:
+
+  r := rules.When(rules.Held("Foyer/Goodnight", 2*time.Second)).
+    Named("goodnight").
+    If(rules.LevelAbove("Kitchen/Island", 0)).
+    Then(rules.Fade("Kitchen/Island", 0, 10*time.Second))
+
+Triggers are a button press, release or hold; an LED change; an output
+level rising above or falling below a threshold; or a time of day.
+Conditions test cached output levels and LED states. Actions fade an
+output, press a button, select a button of an LedGroup added with
+Engine.AddLedGroup, or call a webhook.
+
+Outputs and buttons are names registered with the connection, or
+integration ids: "12" for output 12, "5/3" for button 3 of keypad 5.
+*/
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Default time a button must be held for a hold trigger.
+const DefaultHold = time.Second
+
+// Contents of a rules file.
+type File struct {
+	Rules []*Rule `json:"rules" yaml:"rules"`
+}
+
+// A trigger, the conditions that must hold when it fires, and the
+// actions then run in order.
+type Rule struct {
+	Name       string      `json:"name" yaml:"name"`
+	Trigger    Trigger     `json:"when" yaml:"when"`
+	Conditions []Condition `json:"if" yaml:"if"`
+	Actions    []Action    `json:"then" yaml:"then"`
+}
+
+// Event starting a rule. Exactly one of Button, Led, Output or At
+// must be set.
+type Trigger struct {
+	// Button event: "press" (the default), "release" or "hold".
+	Button string   `json:"button,omitempty" yaml:"button,omitempty"`
+	Event  string   `json:"event,omitempty" yaml:"event,omitempty"`
+	Hold   Duration `json:"hold,omitempty" yaml:"hold,omitempty"`
+
+	// LED of a button changing to State: "off", "on", "flash" or
+	// "rapid"; any change if State is empty.
+	Led   string `json:"led,omitempty" yaml:"led,omitempty"`
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+
+	// Output level rising above Above or falling below Below.
+	Output string   `json:"output,omitempty" yaml:"output,omitempty"`
+	Above  *float64 `json:"above,omitempty" yaml:"above,omitempty"`
+	Below  *float64 `json:"below,omitempty" yaml:"below,omitempty"`
+
+	// Time of day, "15:04" in local time.
+	At string `json:"at,omitempty" yaml:"at,omitempty"`
+}
+
+// Test of the cached state of an output or LED. Levels must be above
+// Above and below Below, if set; an LED must be in State. A condition
+// on an output or LED whose state is not known does not hold.
+type Condition struct {
+	Output string   `json:"output,omitempty" yaml:"output,omitempty"`
+	Above  *float64 `json:"above,omitempty" yaml:"above,omitempty"`
+	Below  *float64 `json:"below,omitempty" yaml:"below,omitempty"`
+
+	Led   string `json:"led,omitempty" yaml:"led,omitempty"`
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+}
+
+// Step of a rule. Exactly one field must be set.
+type Action struct {
+	Fade    *FadeAction    `json:"fade,omitempty" yaml:"fade,omitempty"`
+	Press   string         `json:"press,omitempty" yaml:"press,omitempty"`
+	Select  *SelectAction  `json:"select,omitempty" yaml:"select,omitempty"`
+	Webhook *WebhookAction `json:"webhook,omitempty" yaml:"webhook,omitempty"`
+}
+
+// Fade an output to a level, over the output's default fade if Fade
+// is not set.
+type FadeAction struct {
+	Output string    `json:"output" yaml:"output"`
+	Level  uint8     `json:"level" yaml:"level"`
+	Fade   *Duration `json:"fade,omitempty" yaml:"fade,omitempty"`
+}
+
+// Select a button of a named LedGroup, or turn off every LED in the
+// group if Button is empty.
+type SelectAction struct {
+	Group  string `json:"group" yaml:"group"`
+	Button string `json:"button,omitempty" yaml:"button,omitempty"`
+}
+
+// HTTP request made by a rule. Method defaults to POST.
+type WebhookAction struct {
+	URL     string            `json:"url" yaml:"url"`
+	Method  string            `json:"method,omitempty" yaml:"method,omitempty"`
+	Body    string            `json:"body,omitempty" yaml:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+}
+
+// Duration written in a rules file as a string such as "2s" or "1m30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"2s\"")
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d *Duration) parse(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Start building a rule fired by t.
+func When(t Trigger) *Rule {
+	return &Rule{Trigger: t}
+}
+
+// Set the name used when logging the rule.
+func (r *Rule) Named(name string) *Rule {
+	r.Name = name
+	return r
+}
+
+// Add conditions to the rule.
+func (r *Rule) If(c ...Condition) *Rule {
+	r.Conditions = append(r.Conditions, c...)
+	return r
+}
+
+// Add actions to the rule.
+func (r *Rule) Then(a ...Action) *Rule {
+	r.Actions = append(r.Actions, a...)
+	return r
+}
+
+// Trigger on a press of button.
+func Pressed(button string) Trigger {
+	return Trigger{Button: button, Event: "press"}
+}
+
+// Trigger on a release of button.
+func Released(button string) Trigger {
+	return Trigger{Button: button, Event: "release"}
+}
+
+// Trigger when button is held for d.
+func Held(button string, d time.Duration) Trigger {
+	return Trigger{Button: button, Event: "hold", Hold: Duration(d)}
+}
+
+// Trigger when the LED of button changes to state, or on any change
+// if state is "".
+func LedChanged(button, state string) Trigger {
+	return Trigger{Led: button, State: state}
+}
+
+// Trigger when the level of output rises above level.
+func Rises(output string, level float64) Trigger {
+	return Trigger{Output: output, Above: &level}
+}
+
+// Trigger when the level of output falls below level.
+func Falls(output string, level float64) Trigger {
+	return Trigger{Output: output, Below: &level}
+}
+
+// Trigger daily at clock, "15:04" in local time.
+func At(clock string) Trigger {
+	return Trigger{At: clock}
+}
+
+// Condition holding while the level of output is above level.
+func LevelAbove(output string, level float64) Condition {
+	return Condition{Output: output, Above: &level}
+}
+
+// Condition holding while the level of output is below level.
+func LevelBelow(output string, level float64) Condition {
+	return Condition{Output: output, Below: &level}
+}
+
+// Condition holding while the LED of button is in state.
+func LedIs(button, state string) Condition {
+	return Condition{Led: button, State: state}
+}
+
+// Action fading output to level over fade.
+func Fade(output string, level uint8, fade time.Duration) Action {
+	d := Duration(fade)
+	return Action{Fade: &FadeAction{Output: output, Level: level, Fade: &d}}
+}
+
+// Action pressing and releasing button.
+func Press(button string) Action {
+	return Action{Press: button}
+}
+
+// Action selecting button in a group added with AddLedGroup.
+func Select(group, button string) Action {
+	return Action{Select: &SelectAction{Group: group, Button: button}}
+}
+
+// Action posting to url.
+func Webhook(url string) Action {
+	return Action{Webhook: &WebhookAction{URL: url}}
+}
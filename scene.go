@@ -0,0 +1,285 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Target levels for many outputs and states for many LEDs, applied
+// together. Shades and other loads controlled through #OUTPUT are
+// listed as outputs; the repeater ignores fades they do not support.
+//
+// Scenes are created with NewScene, Capture or LoadScene, and may be
+// saved as JSON:
+//
+//   {
+//     "name": "evening",
+//     "outputs": [
+//       {"id": 12, "level": 45, "fade": "10s"},
+//       {"id": 14, "level": 0}
+//     ],
+//     "leds": [{"keypad": 6, "button": 3, "state": 1}]
+//   }
+type Scene struct {
+	Name    string        `json:"name,omitempty"`
+	Outputs []SceneOutput `json:"outputs,omitempty"`
+	Leds    []SceneLed    `json:"leds,omitempty"`
+
+	conn *Conn
+}
+
+// Level of one output in a scene.
+type SceneOutput struct {
+	Id    int
+	Level uint8
+
+	// Fade time, or the dimmer's default fade if nil.
+	Fade *time.Duration
+}
+
+type sceneOutputJSON struct {
+	Id    int    `json:"id"`
+	Level uint8  `json:"level"`
+	Fade  string `json:"fade,omitempty"`
+}
+
+func (o SceneOutput) MarshalJSON() ([]byte, error) {
+	j := sceneOutputJSON{Id: o.Id, Level: o.Level}
+	if o.Fade != nil {
+		j.Fade = o.Fade.String()
+	}
+	return json.Marshal(&j)
+}
+
+func (o *SceneOutput) UnmarshalJSON(b []byte) error {
+	var j sceneOutputJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.Level > 100 {
+		return fmt.Errorf("output %d: level %d out of range", j.Id, j.Level)
+	}
+	*o = SceneOutput{Id: j.Id, Level: j.Level}
+	if j.Fade != "" {
+		f, err := time.ParseDuration(j.Fade)
+		if err != nil {
+			return fmt.Errorf("output %d: %v", j.Id, err)
+		}
+		o.Fade = &f
+	}
+	return nil
+}
+
+// State of one keypad LED in a scene: LedOff, LedOn, LedNormalFlash
+// or LedRapidFlash. The button must be unprogrammed; see SetLed.
+type SceneLed struct {
+	Keypad int   `json:"keypad"`
+	Button uint8 `json:"button"`
+	State  uint8 `json:"state"`
+}
+
+// Returned by Scene.Apply when outputs or LEDs did not acknowledge
+// their new levels or states.
+type SceneError struct {
+	Scene string
+
+	// Integration ids of outputs that failed.
+	Outputs []int
+
+	// LEDs that failed.
+	Leds []*KeypadButton
+
+	// ctx.Err() if the context passed to Apply ended first.
+	Err error
+}
+
+func (e *SceneError) Error() string {
+	var failed []string
+	for _, id := range e.Outputs {
+		failed = append(failed, fmt.Sprintf("output %d", id))
+	}
+	for _, b := range e.Leds {
+		failed = append(failed, fmt.Sprintf("led %d/%d", b.k.id, b.id))
+	}
+	s := fmt.Sprintf("lutron: scene %q: not acknowledged: %s", e.Scene, strings.Join(failed, ", "))
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *SceneError) Unwrap() error {
+	return e.Err
+}
+
+// Create an empty scene for this connection.
+func (c *Conn) NewScene(name string) *Scene {
+	return &Scene{Name: name, conn: c}
+}
+
+// Add or replace the level of output id, faded over fade.
+func (s *Scene) AddOutput(id int, level uint8, fade time.Duration) *Scene {
+	return s.addOutput(SceneOutput{Id: id, Level: level, Fade: &fade})
+}
+
+func (s *Scene) addOutput(o SceneOutput) *Scene {
+	for i := range s.Outputs {
+		if s.Outputs[i].Id == o.Id {
+			s.Outputs[i] = o
+			return s
+		}
+	}
+	s.Outputs = append(s.Outputs, o)
+	return s
+}
+
+// Add or replace the state of the LED of button on keypad.
+func (s *Scene) AddLed(keypad int, button uint8, state uint8) *Scene {
+	l := SceneLed{Keypad: keypad, Button: button, State: state}
+	for i := range s.Leds {
+		if s.Leds[i].Keypad == keypad && s.Leds[i].Button == button {
+			s.Leds[i] = l
+			return s
+		}
+	}
+	s.Leds = append(s.Leds, l)
+	return s
+}
+
+// Snapshot the levels of outputs ids, or of every known dimmer if no
+// ids are given, into a new scene. Levels not yet known are queried,
+// waiting until ctx is done. Captured outputs use their dimmer's
+// default fade when applied.
+func (c *Conn) Capture(ctx context.Context, ids ...int) (*Scene, error) {
+	if len(ids) == 0 {
+		for _, d := range c.Dimmers() {
+			ids = append(ids, d.id)
+		}
+	}
+
+	replies := make([]chan uint8, len(ids))
+	for i, id := range ids {
+		replies[i] = c.Dimmer(id).Level()
+	}
+
+	s := c.NewScene("")
+	var missing []string
+	for i, r := range replies {
+		level, ok := uint8(0), false
+		select {
+		case level, ok = <-r:
+		case <-ctx.Done():
+			// Deadline passed; collect replies already received.
+			select {
+			case level, ok = <-r:
+			default:
+			}
+		}
+		if ok {
+			s.addOutput(SceneOutput{Id: ids[i], Level: level})
+		} else {
+			missing = append(missing, fmt.Sprint(ids[i]))
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("lutron: capture outputs %s: %v", strings.Join(missing, ", "), ctx.Err())
+	}
+	return s, nil
+}
+
+// Read a scene saved as JSON.
+func (c *Conn) LoadScene(file string) (*Scene, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s := c.NewScene("")
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("lutron: %s: %v", file, err)
+	}
+	return s, nil
+}
+
+// Write the scene to file as JSON.
+func (s *Scene) Save(file string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(b, '\n'), 0644)
+}
+
+// Send every level and LED state in the scene, then wait until all are
+// acknowledged by the main repeater or ctx is done. Commands are queued
+// back to back, retrying while the command queue is full, so outputs
+// begin to fade at nearly the same time. Outputs already at their
+// target level are not sent.
+//
+// If any output or LED fails a *SceneError listing them is returned.
+func (s *Scene) Apply(ctx context.Context) error {
+	type wait struct {
+		output int
+		led    *KeypadButton
+		reply  chan uint8
+	}
+
+	var waits []wait
+	for _, o := range s.Outputs {
+		d := s.conn.Dimmer(o.Id)
+		fade := d.DefaultFade()
+		if o.Fade != nil {
+			fade = *o.Fade
+		}
+		r, _ := s.conn.retryFull(ctx, func() (chan uint8, error) {
+			return d.fadeLevel(o.Level, fade)
+		})
+		waits = append(waits, wait{output: o.Id, reply: r})
+	}
+	for _, l := range s.Leds {
+		b := s.conn.Keypad(l.Keypad).Button(l.Button)
+		r, _ := s.conn.retryFull(ctx, func() (chan uint8, error) {
+			return b.setLed(l.State)
+		})
+		waits = append(waits, wait{led: b, reply: r})
+	}
+
+	e := &SceneError{Scene: s.Name}
+	for _, w := range waits {
+		ok := false
+		if w.reply != nil {
+			select {
+			case _, ok = <-w.reply:
+			case <-ctx.Done():
+				// Deadline passed; collect replies already received.
+				select {
+				case _, ok = <-w.reply:
+				default:
+				}
+			}
+		}
+		if ok {
+			continue
+		}
+		if w.led != nil {
+			e.Leds = append(e.Leds, w.led)
+		} else {
+			e.Outputs = append(e.Outputs, w.output)
+		}
+	}
+	if len(e.Outputs) == 0 && len(e.Leds) == 0 {
+		return nil
+	}
+	sort.Ints(e.Outputs)
+	e.Err = ctx.Err()
+	return e
+}
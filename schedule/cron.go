@@ -0,0 +1,152 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parsed cron expression. Each field is a bit set of allowed values.
+type cron struct {
+	minute, hour, dom, month, dow uint64
+
+	// Day of month and day of week were restricted; if both were, a
+	// day matching either is allowed, as in crontab(5).
+	domSet, dowSet bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Parse a standard five field cron expression: minute, hour, day of
+// month, month and day of week (0 or 7 is Sunday). Fields may be *,
+// numbers, ranges and lists, with optional /step.
+func parseCron(s string) (*cron, error) {
+	f := strings.Fields(s)
+	if len(f) != len(cronFields) {
+		return nil, fmt.Errorf("schedule: cron %q: want 5 fields, have %d", s, len(f))
+	}
+
+	var sets [5]uint64
+	for i, spec := range f {
+		set, err := parseCronField(spec, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: cron %q: %s: %v", s, cronFields[i].name, err)
+		}
+		sets[i] = set
+	}
+	c := &cron{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domSet: f[2] != "*",
+		dowSet: f[4] != "*",
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+func parseCronField(spec string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(spec, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step %q", part[i+1:])
+			}
+			step = n
+			part = part[:i]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			var err error
+			if i := strings.IndexByte(part, '-'); i >= 0 {
+				if lo, err = strconv.Atoi(part[:i]); err == nil {
+					hi, err = strconv.Atoi(part[i+1:])
+				}
+			} else if lo, err = strconv.Atoi(part); err == nil {
+				hi = lo
+				if step > 1 {
+					hi = max
+				}
+			}
+			if err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (c *cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domSet && c.dowSet {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// First time matching the expression strictly after t, in t's location,
+// or the zero time if there is none within a few years.
+func (c *cron) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = advance(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// Move from t to n, or by a minute if a daylight saving transition
+// placed n at or before t.
+func advance(t, n time.Time) time.Time {
+	if n.After(t) {
+		return n
+	}
+	return t.Add(time.Minute)
+}
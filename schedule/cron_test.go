@@ -0,0 +1,112 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func bits(vs ...int) uint64 {
+	var r uint64
+	for _, v := range vs {
+		r |= 1 << uint(v)
+	}
+	return r
+}
+
+func TestParseCron(t *testing.T) {
+	all := func(min, max int) uint64 {
+		var r uint64
+		for v := min; v <= max; v++ {
+			r |= 1 << uint(v)
+		}
+		return r
+	}
+
+	for _, tc := range []struct {
+		spec string
+		want *cron // nil if spec is invalid.
+	}{
+		{"* * * * *", &cron{all(0, 59), all(0, 23), all(1, 31), all(1, 12), all(0, 7), false, false}},
+		{"30 7 * * 1-5", &cron{bits(30), bits(7), all(1, 31), all(1, 12), bits(1, 2, 3, 4, 5), false, true}},
+		{"*/15 0,12 1 */3 *", &cron{bits(0, 15, 30, 45), bits(0, 12), bits(1), bits(1, 4, 7, 10), all(0, 7), true, false}},
+		{"5/20 8-10/2 * * 0", &cron{bits(5, 25, 45), bits(8, 10), all(1, 31), all(1, 12), bits(0), false, true}},
+		{"0 0 13 * 7", &cron{bits(0), bits(0), bits(13), all(1, 12), bits(0, 7), true, true}},
+		{"  0  0  *  *  *  ", &cron{bits(0), bits(0), all(1, 31), all(1, 12), all(0, 7), false, false}},
+		{"* * * *", nil},
+		{"* * * * * *", nil},
+		{"60 * * * *", nil},
+		{"* 24 * * *", nil},
+		{"* * 0 * *", nil},
+		{"* * * 13 *", nil},
+		{"* * * * 8", nil},
+		{"5-1 * * * *", nil},
+		{"*/0 * * * *", nil},
+		{"a * * * *", nil},
+		{"1- * * * *", nil},
+		{"1,,2 * * * *", nil},
+	} {
+		got, err := parseCron(tc.spec)
+		switch {
+		case tc.want == nil:
+			if err == nil {
+				t.Errorf("parseCron(%q) = %+v, want error", tc.spec, got)
+			}
+		case err != nil:
+			t.Errorf("parseCron(%q): %v", tc.spec, err)
+		case *got != *tc.want:
+			t.Errorf("parseCron(%q) = %+v, want %+v", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	ny := location(t, "America/New_York")
+	at := func(y int, m time.Month, d, h, min int) time.Time {
+		return time.Date(y, m, d, h, min, 0, 0, ny)
+	}
+
+	for _, tc := range []struct {
+		spec  string
+		after time.Time
+		want  time.Time
+	}{
+		{"30 7 * * *", at(2024, 5, 1, 7, 0), at(2024, 5, 1, 7, 30)},
+		{"30 7 * * *", at(2024, 5, 1, 7, 30), at(2024, 5, 2, 7, 30)},
+		{"30 7 * * *", time.Date(2024, 5, 1, 7, 29, 59, 0, ny), at(2024, 5, 1, 7, 30)},
+		{"*/15 * * * *", at(2024, 5, 1, 23, 50), at(2024, 5, 2, 0, 0)},
+		{"0 7 * * 1-5", at(2024, 3, 8, 8, 0), at(2024, 3, 11, 7, 0)},
+		{"0 0 1 * *", at(2024, 1, 31, 12, 0), at(2024, 2, 1, 0, 0)},
+		{"0 0 31 * *", at(2024, 4, 1, 0, 0), at(2024, 5, 31, 0, 0)},
+		{"0 0 1 1 *", at(2024, 6, 1, 0, 0), at(2025, 1, 1, 0, 0)},
+
+		// Day of month or day of week: Friday the 6th before the 13th.
+		{"0 0 13 * 5", at(2024, 9, 1, 0, 0), at(2024, 9, 6, 0, 0)},
+		{"0 0 * * 0", at(2024, 9, 1, 0, 0), at(2024, 9, 8, 0, 0)},
+		{"0 0 * * 7", at(2024, 9, 1, 0, 0), at(2024, 9, 8, 0, 0)},
+
+		{"0 0 29 2 *", at(2024, 3, 1, 0, 0), at(2028, 2, 29, 0, 0)},
+		{"0 0 30 2 *", at(2024, 3, 1, 0, 0), time.Time{}},
+
+		// Daylight saving time starts at 02:00 on March 10, 2024.
+		{"0 3 * * *", at(2024, 3, 9, 3, 0), at(2024, 3, 10, 3, 0)},
+		{"30 2 * * *", at(2024, 3, 10, 0, 0), at(2024, 3, 11, 2, 30)},
+		{"0 * * * *", at(2024, 3, 10, 1, 0), at(2024, 3, 10, 3, 0)},
+
+		// And ends at 02:00 on November 3, 2024.
+		{"0 3 * * *", at(2024, 11, 2, 3, 0), at(2024, 11, 3, 3, 0)},
+		{"0 0 * * *", at(2024, 11, 2, 12, 0), at(2024, 11, 3, 0, 0)},
+	} {
+		c, err := parseCron(tc.spec)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tc.spec, err)
+		}
+		if got := c.next(tc.after); !got.Equal(tc.want) {
+			t.Errorf("%q after %v = %v, want %v", tc.spec, tc.after, got, tc.want)
+		}
+	}
+}
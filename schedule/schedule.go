@@ -0,0 +1,471 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package schedule runs jobs against a lutron connection at cron times or
+relative to sunrise, sunset and civil twilight, so schedules can change
+without reprogramming the main repeater's timeclock.
+
+Sun times are computed locally for the latitude and longitude given to
+New; no network service is used:
+
+  s := schedule.New(37.42, -122.08)
+  s.StateFile = "/var/lib/lutron/schedule.json"
+  s.Add(schedule.Job{
+    Name:    "porch on",
+    Sun:     schedule.Sunset,
+    Offset:  -15 * time.Minute,
+    Actions: []schedule.Action{schedule.On(conn.Switch(20))},
+  })
+  s.Add(schedule.Job{
+    Name:    "weekday wake",
+    Cron:    "30 6 * * 1-5",
+    Actions: []schedule.Action{schedule.Fade(conn.Dimmer(12), 60, time.Minute)},
+  })
+  log.Fatal(s.Run(ctx))
+
+A job's Random spreads each run uniformly over that much time either
+side of the scheduled time, so lights left on a schedule while the house
+is empty do not switch at the same minute every day.
+
+When StateFile is set the time of each job's last run is saved there.
+After downtime a job with Missed set to RunMissed runs once on start if
+it was due while the scheduler was not running.
+*/
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spearce/lutron"
+	"github.com/spearce/lutron/internal/atomicfile"
+)
+
+const (
+	// Time allowed for each action of a job to complete.
+	actionTimeout = 10 * time.Second
+
+	// Longest sleep between checks of the wall clock, which may jump
+	// while the host is suspended or its clock is set.
+	maxSleep = time.Minute
+)
+
+// Days of the week a job may run on.
+type Days uint8
+
+const (
+	Everyday Days = 0x7f
+	Weekdays Days = 0x3e
+	Weekends Days = 0x41
+)
+
+// Days containing each of d.
+func DaysOf(d ...time.Weekday) Days {
+	var r Days
+	for _, w := range d {
+		r |= 1 << uint(w)
+	}
+	return r
+}
+
+// Whether d includes w. The zero Days includes every day.
+func (d Days) Has(w time.Weekday) bool {
+	return d == 0 || d&(1<<uint(w)) != 0
+}
+
+// What to do on start for a job that was due while the scheduler was
+// not running.
+type MissedPolicy int
+
+const (
+	SkipMissed MissedPolicy = iota // Wait for the next scheduled time.
+	RunMissed                      // Run once, then wait.
+)
+
+// Step of a job. The context is done if the step takes longer than
+// 10 seconds.
+type Action func(ctx context.Context) error
+
+// A set of actions and when to run them. Exactly one of Cron and Sun
+// must be set.
+type Job struct {
+	// Unique name, used in logs and the state file.
+	Name string
+
+	// Standard five field cron expression in the scheduler's location,
+	// e.g. "30 6 * * 1-5" for 6:30 on weekdays.
+	Cron string
+
+	// Sun event, and the offset from it: -15*time.Minute is a quarter
+	// of an hour before the event.
+	Sun    SunEvent
+	Offset time.Duration
+
+	// Days the job may run on; every day if zero. For sun events this
+	// is the day of the event, before Offset is applied.
+	Days Days
+
+	// Maximum random time added to or subtracted from each run.
+	Random time.Duration
+
+	// Handling of a run missed while the scheduler was not running.
+	// With RunMissed only runs missed within the last Grace are made
+	// up, if Grace is set.
+	Missed MissedPolicy
+	Grace  time.Duration
+
+	// Actions run in order.
+	Actions []Action
+}
+
+// Runs jobs at their scheduled times.
+type Scheduler struct {
+	// Logger recording each run; slog.Default() if nil.
+	Logger *slog.Logger
+
+	// Location of cron times and calendar days; time.Local if nil.
+	Location *time.Location
+
+	// File recording the last run of each job; runs are not recorded
+	// if empty.
+	StateFile string
+
+	lat, lon float64
+
+	mu   sync.Mutex
+	jobs []*scheduled
+	last map[string]time.Time
+
+	saving sync.Mutex // Held while writing StateFile.
+}
+
+type scheduled struct {
+	Job
+	cron *cron
+}
+
+// Create a scheduler with no jobs for latitude lat and longitude lon,
+// in degrees, with north and east positive.
+func New(lat, lon float64) *Scheduler {
+	return &Scheduler{
+		lat:  lat,
+		lon:  lon,
+		last: make(map[string]time.Time),
+	}
+}
+
+// Add a job. Jobs must be added before Run is called.
+func (s *Scheduler) Add(j Job) error {
+	sj := &scheduled{Job: j}
+	switch {
+	case j.Name == "":
+		return errors.New("schedule: job has no name")
+	case (j.Cron == "") == (j.Sun == NoSunEvent):
+		return fmt.Errorf("schedule: job %s: exactly one of Cron and Sun must be set", j.Name)
+	case j.Cron != "" && j.Offset != 0:
+		return fmt.Errorf("schedule: job %s: Offset requires Sun", j.Name)
+	case j.Random < 0:
+		return fmt.Errorf("schedule: job %s: negative Random", j.Name)
+	case len(j.Actions) == 0:
+		return fmt.Errorf("schedule: job %s: no actions", j.Name)
+	}
+	if j.Cron != "" {
+		c, err := parseCron(j.Cron)
+		if err != nil {
+			return err
+		}
+		sj.cron = c
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, o := range s.jobs {
+		if o.Name == j.Name {
+			return fmt.Errorf("schedule: duplicate job %s", j.Name)
+		}
+	}
+	s.jobs = append(s.jobs, sj)
+	return nil
+}
+
+// Next scheduled time of the named job after t, before any random
+// offset is applied. Returns the zero time if the job is unknown or
+// will not run again.
+func (s *Scheduler) Next(name string, t time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.Name == name {
+			return s.next(j, t)
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Scheduler) location() *time.Location {
+	if s.Location != nil {
+		return s.Location
+	}
+	return time.Local
+}
+
+func (s *Scheduler) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+func (s *Scheduler) next(j *scheduled, t time.Time) time.Time {
+	t = t.In(s.location())
+	if j.cron != nil {
+		for {
+			t = j.cron.next(t)
+			if t.IsZero() || j.Days.Has(t.Weekday()) {
+				return t
+			}
+		}
+	}
+
+	// Start a day early in case a large Offset moves the previous
+	// day's event past t.
+	y, m, d := t.Date()
+	for i := -1; i <= 366; i++ {
+		day := time.Date(y, m, d+i, 12, 0, 0, 0, t.Location())
+		if !j.Days.Has(day.Weekday()) {
+			continue
+		}
+		at, ok := SunTime(j.Sun, day, s.lat, s.lon)
+		if !ok {
+			continue
+		}
+		if at = at.Add(j.Offset); at.After(t) {
+			return at
+		}
+	}
+	return time.Time{}
+}
+
+// Time to run a job due at base.
+func (j *scheduled) jitter(base time.Time) time.Time {
+	if j.Random <= 0 {
+		return base
+	}
+	return base.Add(time.Duration(rand.Int63n(int64(2*j.Random)+1)) - j.Random)
+}
+
+type pending struct {
+	job  *scheduled
+	base time.Time // Scheduled time.
+	at   time.Time // Scheduled time with random offset.
+}
+
+// Run jobs until ctx is done, returning ctx.Err(). Missed jobs are run
+// first, in the order they were added.
+func (s *Scheduler) Run(ctx context.Context) error {
+	if err := s.loadState(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	jobs := append([]*scheduled(nil), s.jobs...)
+	s.mu.Unlock()
+
+	now := time.Now()
+	var queue []*pending
+	for _, j := range jobs {
+		if due := s.missed(j, now); !due.IsZero() {
+			s.logger().Info("running missed job", "job", j.Name, "scheduled", due)
+			s.run(ctx, j, due)
+		}
+		base := s.next(j, now)
+		if base.IsZero() {
+			s.logger().Warn("job will not run", "job", j.Name)
+			continue
+		}
+		queue = append(queue, &pending{job: j, base: base, at: j.jitter(base)})
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		var p *pending
+		for _, q := range queue {
+			if q.base.IsZero() {
+				continue
+			}
+			if p == nil || q.at.Before(p.at) {
+				p = q
+			}
+		}
+
+		if p == nil {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+
+		d := time.Until(p.at)
+		if d > maxSleep {
+			d = maxSleep
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		if time.Now().Before(p.at) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(j *scheduled, base time.Time) {
+			defer wg.Done()
+			s.run(ctx, j, base)
+		}(p.job, p.base)
+
+		p.base = s.next(p.job, p.base)
+		p.at = p.job.jitter(p.base)
+	}
+}
+
+// Most recent time j was due while the scheduler was not running, if
+// it should be made up; the zero time otherwise.
+func (s *Scheduler) missed(j *scheduled, now time.Time) time.Time {
+	s.mu.Lock()
+	last, ok := s.last[j.Name]
+	s.mu.Unlock()
+	if !ok || j.Missed != RunMissed {
+		return time.Time{}
+	}
+
+	if j.Grace > 0 && last.Before(now.Add(-j.Grace)) {
+		last = now.Add(-j.Grace)
+	}
+	var due time.Time
+	for t := s.next(j, last); !t.IsZero() && t.Before(now); t = s.next(j, t) {
+		due = t
+	}
+	return due
+}
+
+// Run the actions of j, due at base, and record the run.
+func (s *Scheduler) run(ctx context.Context, j *scheduled, base time.Time) {
+	log := s.logger().With("job", j.Name)
+	log.Info("job running", "scheduled", base)
+	for i, a := range j.Actions {
+		actx, cancel := context.WithTimeout(ctx, actionTimeout)
+		err := a(actx)
+		cancel()
+		if err != nil {
+			log.Warn("job action failed", "action", i+1, "err", err)
+		}
+	}
+
+	s.mu.Lock()
+	if base.After(s.last[j.Name]) {
+		s.last[j.Name] = base
+	}
+	s.mu.Unlock()
+	if err := s.saveState(); err != nil {
+		log.Error("schedule state not saved", "file", s.StateFile, "err", err)
+	}
+}
+
+// Action fading d to level over fade.
+func Fade(d *lutron.Dimmer, level uint8, fade time.Duration) Action {
+	return func(ctx context.Context) error {
+		_, err := lutron.Wait(ctx, d.Fade(level, fade))
+		return err
+	}
+}
+
+// Action turning sw on.
+func On(sw *lutron.Switch) Action {
+	return func(ctx context.Context) error {
+		_, err := lutron.Wait(ctx, sw.On())
+		return err
+	}
+}
+
+// Action turning sw off.
+func Off(sw *lutron.Switch) Action {
+	return func(ctx context.Context) error {
+		_, err := lutron.Wait(ctx, sw.Off())
+		return err
+	}
+}
+
+// Action pressing and releasing b.
+func Press(b *lutron.KeypadButton) Action {
+	return func(ctx context.Context) error {
+		_, err := lutron.Wait(ctx, b.Press())
+		return err
+	}
+}
+
+// Contents of the state file.
+type savedState struct {
+	Jobs map[string]time.Time `json:"jobs"`
+}
+
+func (s *Scheduler) loadState() error {
+	if s.StateFile == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(s.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var st savedState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return fmt.Errorf("schedule: %s: %v", s.StateFile, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, t := range st.Jobs {
+		s.last[name] = t
+	}
+	return nil
+}
+
+func (s *Scheduler) saveState() error {
+	if s.StateFile == "" {
+		return nil
+	}
+	s.saving.Lock()
+	defer s.saving.Unlock()
+
+	s.mu.Lock()
+	st := savedState{Jobs: make(map[string]time.Time, len(s.last))}
+	for name, t := range s.last {
+		st.Jobs[name] = t
+	}
+	b, err := json.MarshalIndent(&st, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return atomicfile.Write(s.StateFile, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
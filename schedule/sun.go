@@ -0,0 +1,128 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"math"
+	"time"
+)
+
+// Position of the sun that a job may be scheduled relative to.
+type SunEvent int
+
+const (
+	NoSunEvent SunEvent = iota
+	Sunrise
+	Sunset
+
+	// Start of morning and end of evening civil twilight, when the sun
+	// is 6 degrees below the horizon.
+	CivilDawn
+	CivilDusk
+)
+
+func (e SunEvent) String() string {
+	switch e {
+	case Sunrise:
+		return "sunrise"
+	case Sunset:
+		return "sunset"
+	case CivilDawn:
+		return "civil dawn"
+	case CivilDusk:
+		return "civil dusk"
+	}
+	return "none"
+}
+
+// Zenith angles, in degrees, of the sun at each event. Sunrise and
+// sunset allow for refraction and the radius of the sun's disk.
+const (
+	zenithOfficial = 90.833
+	zenithCivil    = 96
+)
+
+// Time of a sun event on the calendar day of day, in day's location,
+// at latitude lat and longitude lon (degrees, east positive). ok is
+// false if the event does not occur that day, as in polar summer or
+// winter. Times are accurate to a minute or two.
+func SunTime(e SunEvent, day time.Time, lat, lon float64) (t time.Time, ok bool) {
+	switch e {
+	case Sunrise:
+		return sunTime(day, lat, lon, zenithOfficial, true)
+	case Sunset:
+		return sunTime(day, lat, lon, zenithOfficial, false)
+	case CivilDawn:
+		return sunTime(day, lat, lon, zenithCivil, true)
+	case CivilDusk:
+		return sunTime(day, lat, lon, zenithCivil, false)
+	}
+	return time.Time{}, false
+}
+
+// Sunrise equation from the Almanac for Computers (1990), as published
+// by the US Naval Observatory.
+func sunTime(day time.Time, lat, lon, zenith float64, rising bool) (time.Time, bool) {
+	const rad = math.Pi / 180
+	y, m, d := day.Date()
+	n := float64(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).YearDay())
+
+	lngHour := lon / 15
+	var t float64
+	if rising {
+		t = n + (6-lngHour)/24
+	} else {
+		t = n + (18-lngHour)/24
+	}
+
+	// Sun's mean anomaly and true longitude.
+	M := 0.9856*t - 3.289
+	L := normalize(M+1.916*math.Sin(M*rad)+0.020*math.Sin(2*M*rad)+282.634, 360)
+
+	// Right ascension, in the same quadrant as L, in hours.
+	RA := normalize(math.Atan(0.91764*math.Tan(L*rad))/rad, 360)
+	RA += math.Floor(L/90)*90 - math.Floor(RA/90)*90
+	RA /= 15
+
+	sinDec := 0.39782 * math.Sin(L*rad)
+	cosDec := math.Cos(math.Asin(sinDec))
+	cosH := (math.Cos(zenith*rad) - sinDec*math.Sin(lat*rad)) / (cosDec * math.Cos(lat*rad))
+	if cosH > 1 || cosH < -1 {
+		return time.Time{}, false
+	}
+
+	H := math.Acos(cosH) / rad
+	if rising {
+		H = 360 - H
+	}
+	H /= 15
+
+	T := H + RA - 0.06571*t - 6.622
+	UT := normalize(T-lngHour, 24)
+
+	r := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).
+		Add(time.Duration(UT * float64(time.Hour))).
+		In(day.Location()).
+		Truncate(time.Second)
+
+	// UT is only known modulo a day; move to the requested local date.
+	ry, rm, rd := r.Date()
+	switch c := time.Date(ry, rm, rd, 0, 0, 0, 0, time.UTC).Sub(time.Date(y, m, d, 0, 0, 0, 0, time.UTC)); {
+	case c < 0:
+		r = r.Add(24 * time.Hour)
+	case c > 0:
+		r = r.Add(-24 * time.Hour)
+	}
+	return r, true
+}
+
+func normalize(v, max float64) float64 {
+	v = math.Mod(v, max)
+	if v < 0 {
+		v += max
+	}
+	return v
+}
@@ -0,0 +1,80 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package schedule
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func location(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestSunTime(t *testing.T) {
+	la := location(t, "America/Los_Angeles")
+	london := location(t, "Europe/London")
+	ny := location(t, "America/New_York")
+	oslo := location(t, "Europe/Oslo")
+
+	// Published times; SunTime is accurate to a minute or two.
+	for _, tc := range []struct {
+		name     string
+		day      time.Time
+		lat, lon float64
+		event    SunEvent
+		want     time.Time // Zero if the event does not occur.
+	}{
+		{"summer sunrise", time.Date(2024, 6, 21, 12, 0, 0, 0, la), 37.42, -122.08,
+			Sunrise, time.Date(2024, 6, 21, 5, 48, 0, 0, la)},
+		{"summer sunset", time.Date(2024, 6, 21, 12, 0, 0, 0, la), 37.42, -122.08,
+			Sunset, time.Date(2024, 6, 21, 20, 33, 0, 0, la)},
+		{"summer dusk", time.Date(2024, 6, 21, 12, 0, 0, 0, la), 37.42, -122.08,
+			CivilDusk, time.Date(2024, 6, 21, 21, 4, 0, 0, la)},
+		{"winter sunrise", time.Date(2024, 12, 21, 12, 0, 0, 0, london), 51.5, -0.13,
+			Sunrise, time.Date(2024, 12, 21, 8, 4, 0, 0, london)},
+		{"winter sunset", time.Date(2024, 12, 21, 12, 0, 0, 0, london), 51.5, -0.13,
+			Sunset, time.Date(2024, 12, 21, 15, 53, 0, 0, london)},
+		{"before daylight saving", time.Date(2024, 3, 9, 12, 0, 0, 0, ny), 40.71, -74.01,
+			Sunrise, time.Date(2024, 3, 9, 6, 17, 0, 0, ny)},
+		{"daylight saving starts", time.Date(2024, 3, 10, 12, 0, 0, 0, ny), 40.71, -74.01,
+			Sunrise, time.Date(2024, 3, 10, 7, 15, 0, 0, ny)},
+		{"daylight saving ends", time.Date(2024, 11, 3, 12, 0, 0, 0, ny), 40.71, -74.01,
+			Sunset, time.Date(2024, 11, 3, 16, 50, 0, 0, ny)},
+		{"midnight day", time.Date(2024, 3, 10, 0, 0, 0, 0, ny), 40.71, -74.01,
+			Sunset, time.Date(2024, 3, 10, 18, 59, 0, 0, ny)},
+		{"polar day sunrise", time.Date(2024, 6, 21, 12, 0, 0, 0, oslo), 69.65, 18.96,
+			Sunrise, time.Time{}},
+		{"polar day sunset", time.Date(2024, 6, 21, 12, 0, 0, 0, oslo), 69.65, 18.96,
+			Sunset, time.Time{}},
+		{"polar night", time.Date(2024, 12, 21, 12, 0, 0, 0, oslo), 69.65, 18.96,
+			Sunrise, time.Time{}},
+		{"polar night dawn", time.Date(2024, 12, 21, 12, 0, 0, 0, oslo), 69.65, 18.96,
+			CivilDawn, time.Date(2024, 12, 21, 9, 32, 0, 0, oslo)},
+		{"no event", time.Date(2024, 6, 21, 12, 0, 0, 0, la), 37.42, -122.08,
+			NoSunEvent, time.Time{}},
+	} {
+		got, ok := SunTime(tc.event, tc.day, tc.lat, tc.lon)
+		switch {
+		case tc.want.IsZero():
+			if ok {
+				t.Errorf("%s: SunTime(%v) = %v, want none", tc.name, tc.event, got)
+			}
+		case !ok:
+			t.Errorf("%s: SunTime(%v) = none, want %v", tc.name, tc.event, tc.want)
+		case got.Sub(tc.want).Abs() > 2*time.Minute:
+			t.Errorf("%s: SunTime(%v) = %v, want %v", tc.name, tc.event, got, tc.want)
+		case got.Location() != tc.day.Location():
+			t.Errorf("%s: SunTime(%v) in %v, want %v", tc.name, tc.event, got.Location(), tc.day.Location())
+		}
+	}
+}
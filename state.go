@@ -0,0 +1,234 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/spearce/lutron/internal/atomicfile"
+)
+
+const (
+	// Default delay between queries refreshing stale state.
+	DefaultRefreshInterval = 200 * time.Millisecond
+
+	// How often the state file is rewritten.
+	stateSaveInterval = time.Minute
+)
+
+// Snapshot of known levels written to the state file.
+type savedState struct {
+	Dimmers map[int]uint8           `json:"dimmers"`
+	Leds    map[int]map[uint8]uint8 `json:"leds"`
+}
+
+// Persist dimmer levels and LED states to file, and reload them when
+// the connection is established. Reloaded values are "stale": they are
+// served immediately by Dimmer.Level(), Dimmer.AddMonitor() and
+// KeypadButton.MonitorLed() instead of querying the main repeater, and
+// are refreshed in the background at the rate set by WithRefreshInterval.
+//
+// Use Dimmer.CachedLevel() or KeypadButton.CachedLed() to determine if
+// a value is stale. LevelChange.Stale is set on stale monitor updates.
+func WithStateFile(file string) Option {
+	return func(c *Conn) {
+		c.stateFile = file
+	}
+}
+
+// Set the delay between queries used to refresh stale state loaded from
+// the state file. Defaults to DefaultRefreshInterval.
+func WithRefreshInterval(d time.Duration) Option {
+	return func(c *Conn) {
+		c.refreshInterval = d
+	}
+}
+
+// Write the current dimmer levels and LED states to the state file.
+// The file is also written periodically in the background.
+func (c *Conn) SaveState() error {
+	if c.stateFile == "" {
+		return nil
+	}
+
+	s := savedState{
+		Dimmers: make(map[int]uint8),
+		Leds:    make(map[int]map[uint8]uint8),
+	}
+	for _, d := range c.Dimmers() {
+		if level, _, ok := d.CachedLevel(); ok {
+			s.Dimmers[d.id] = level
+		}
+	}
+	for _, k := range c.Keypads() {
+		if leds := k.CachedLeds(); len(leds) > 0 {
+			s.Leds[k.id] = leds
+		}
+	}
+
+	b, err := json.MarshalIndent(&s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(c.stateFile, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+func (c *Conn) loadState() error {
+	b, err := ioutil.ReadFile(c.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var s savedState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("lutron: %s: %v", c.stateFile, err)
+	}
+	for id, level := range s.Dimmers {
+		d := c.Dimmer(id)
+		d.mu.Lock()
+		d.level = level
+		d.stale = true
+		d.mu.Unlock()
+	}
+	for id, leds := range s.Leds {
+		k := c.Keypad(id)
+		k.mu.Lock()
+		k.stale = leds
+		k.mu.Unlock()
+	}
+	return nil
+}
+
+// Query every stale object, one at a time, then save the state file
+// periodically for the life of the connection. Queries rejected with
+// ErrQueueFull are retried. Close saves the file a final time.
+func (c *Conn) refreshState() {
+	interval := c.refreshInterval
+	if interval <= 0 {
+		interval = DefaultRefreshInterval
+	}
+
+	var queries []func() error
+	for _, d := range c.Dimmers() {
+		queries = append(queries, d.refreshStale)
+	}
+	for _, k := range c.Keypads() {
+		k.mu.Lock()
+		for led := range k.stale {
+			queries = append(queries, k.refreshStale(led))
+		}
+		k.mu.Unlock()
+	}
+
+	save := time.NewTicker(stateSaveInterval)
+	defer save.Stop()
+	refresh := time.NewTicker(interval)
+	defer refresh.Stop()
+	for {
+		next := refresh.C
+		if len(queries) == 0 {
+			next = nil
+		}
+
+		select {
+		case <-next:
+			if err := queries[0](); err != nil {
+				c.log.Debug("lutron refresh deferred", "err", err)
+				continue
+			}
+			queries = queries[1:]
+		case <-save.C:
+			c.saveStateLogged()
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *Conn) saveStateLogged() {
+	if err := c.SaveState(); err != nil {
+		c.log.Warn("lutron saving state failed", "file", c.stateFile, "err", err)
+	}
+}
+
+// Query the level if it is still stale.
+func (d *Dimmer) refreshStale() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.stale || d.valid || d.querying {
+		return nil
+	}
+	err := d.send('?', "1", priorityBackground)
+	d.querying = err == nil
+	return err
+}
+
+// Query the state of led if it is still stale.
+func (k *Keypad) refreshStale(led uint8) func() error {
+	return func() error {
+		k.mu.Lock()
+		_, stale := k.stale[led]
+		k.mu.Unlock()
+		if !stale {
+			return nil
+		}
+		return k.send('?', fmt.Sprintf("%d,9", 80+led), priorityBackground)
+	}
+}
+
+// Get the last known level of the dimmer without waiting. stale is true
+// if the level was loaded from the state file (see WithStateFile) and
+// has not yet been confirmed by the main repeater. ok is false if the
+// level is not known.
+func (d *Dimmer) CachedLevel() (level uint8, stale bool, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.level, d.stale && !d.valid, d.valid || d.stale
+}
+
+// Get the last known state of the button's LED without waiting. stale
+// is true if the state was loaded from the state file (see WithStateFile)
+// and has not yet been confirmed by the main repeater. ok is false if
+// the state is not known, which is common for LEDs that are not monitored.
+func (b *KeypadButton) CachedLed() (state uint8, stale bool, ok bool) {
+	k := b.k
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if s, ok := k.states[b.id]; ok {
+		return s, false, true
+	}
+	if s, ok := k.stale[b.id]; ok {
+		return s, true, true
+	}
+	return LedUndefined, false, false
+}
+
+// Get the last known state of every LED on the keypad whose state has
+// been observed, including stale states loaded from the state file.
+func (k *Keypad) CachedLeds() map[uint8]uint8 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	r := make(map[uint8]uint8)
+	for led, s := range k.stale {
+		r[led] = s
+	}
+	for led, s := range k.states {
+		r[led] = s
+	}
+	return r
+}
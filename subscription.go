@@ -0,0 +1,233 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import "sync"
+
+const (
+	// Default number of events held for a slow monitor.
+	DefaultMonitorBuffer = 16
+)
+
+// Behavior of a monitor when its buffer is full.
+type Overflow int
+
+const (
+	// Replace a waiting event for the same dimmer or LED with the newest
+	// one, so the latest level is still delivered. If there is no such
+	// event, or for button events, drop the oldest event.
+	Coalesce Overflow = iota
+
+	// Drop the oldest waiting event to make room.
+	DropOldest
+
+	// Drop the new event.
+	DropNewest
+
+	// Wait for the monitor to receive. A blocked monitor stalls
+	// processing of all events from the main repeater.
+	Block
+)
+
+// Delivery options for monitors. The zero value buffers
+// DefaultMonitorBuffer events and coalesces on overflow.
+type MonitorOptions struct {
+	Buffer   int
+	Overflow Overflow
+}
+
+// Delivery of the Monitor and AddMonitor methods, which predate
+// subscriptions: every event is delivered, blocking when the receiver
+// falls behind.
+var blockingMonitor = MonitorOptions{Overflow: Block}
+
+// Registration of a channel to receive events. Events are queued for
+// the subscriber and written to its channel by a separate goroutine,
+// so a slow receiver does not delay other monitors.
+type Subscription struct {
+	buffer   int
+	overflow Overflow
+	key      func(interface{}) interface{} // nil key is never coalesced.
+	send     func(interface{}, chan struct{}) bool
+	remove   func(*Subscription)
+
+	mu      sync.Mutex
+	space   *sync.Cond
+	events  []interface{}
+	dropped uint64
+	closed  bool
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+func newSubscription(o MonitorOptions,
+	key func(interface{}) interface{},
+	send func(interface{}, chan struct{}) bool) *Subscription {
+	s := &Subscription{
+		buffer:   o.Buffer,
+		overflow: o.Overflow,
+		key:      key,
+		send:     send,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if s.buffer <= 0 {
+		s.buffer = DefaultMonitorBuffer
+	}
+	s.space = sync.NewCond(&s.mu)
+	go s.run()
+	return s
+}
+
+func levelSubscription(c chan LevelChange, o MonitorOptions) *Subscription {
+	return newSubscription(o,
+		func(e interface{}) interface{} { return e.(LevelChange).Dimmer },
+		func(e interface{}, done chan struct{}) bool {
+			select {
+			case c <- e.(LevelChange):
+				return true
+			case <-done:
+				return false
+			}
+		})
+}
+
+func stateSubscription(c chan uint8, o MonitorOptions, coalesce bool) *Subscription {
+	var key func(interface{}) interface{}
+	if coalesce {
+		key = func(interface{}) interface{} { return true }
+	}
+	return newSubscription(o, key,
+		func(e interface{}, done chan struct{}) bool {
+			select {
+			case c <- e.(uint8):
+				return true
+			case <-done:
+				return false
+			}
+		})
+}
+
+// Number of events discarded because the subscriber was not receiving.
+func (s *Subscription) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Stop delivering events. Events not yet received are discarded.
+// The subscriber's channel is not closed.
+func (s *Subscription) Unsubscribe() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.events = nil
+	close(s.done)
+	s.space.Broadcast()
+	s.mu.Unlock()
+
+	if s.remove != nil {
+		s.remove(s)
+	}
+}
+
+// Queue an event for delivery. Never blocks unless the overflow
+// policy is Block.
+func (s *Subscription) push(e interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	if len(s.events) >= s.buffer {
+		switch s.overflow {
+		case Block:
+			for len(s.events) >= s.buffer && !s.closed {
+				s.space.Wait()
+			}
+			if s.closed {
+				return
+			}
+		case DropNewest:
+			s.dropped++
+			return
+		case Coalesce:
+			s.dropped++
+			if i := s.waiting(e); i >= 0 {
+				s.events[i] = e
+				return
+			}
+			s.events = s.events[1:]
+		default:
+			s.events = s.events[1:]
+			s.dropped++
+		}
+	}
+	s.events = append(s.events, e)
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Index of a waiting event with the same key as e, or -1. s.mu must be
+// held.
+func (s *Subscription) waiting(e interface{}) int {
+	if s.key == nil {
+		return -1
+	}
+	k := s.key(e)
+	if k == nil {
+		return -1
+	}
+	for i, o := range s.events {
+		if s.key(o) == k {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Subscription) run() {
+	for {
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+
+		for {
+			s.mu.Lock()
+			if len(s.events) == 0 {
+				s.mu.Unlock()
+				break
+			}
+			e := s.events[0]
+			s.events = s.events[1:]
+			s.space.Signal()
+			s.mu.Unlock()
+
+			if !s.send(e, s.done) {
+				return
+			}
+		}
+	}
+}
+
+func removeSubscription(l []*Subscription, s *Subscription) []*Subscription {
+	var r []*Subscription
+	for _, e := range l {
+		if e != s {
+			r = append(r, e)
+		}
+	}
+	return r
+}
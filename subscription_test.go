@@ -0,0 +1,176 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Event with a coalescing key; empty keys are never coalesced.
+type testEvent struct {
+	key string
+	n   int
+}
+
+func (e testEvent) String() string { return fmt.Sprintf("%s%d", e.key, e.n) }
+
+// Subscription delivering testEvents to an unbuffered channel.
+func testSubscription(o MonitorOptions) (*Subscription, chan testEvent) {
+	c := make(chan testEvent)
+	s := newSubscription(o,
+		func(e interface{}) interface{} {
+			if k := e.(testEvent).key; k != "" {
+				return k
+			}
+			return nil
+		},
+		func(e interface{}, done chan struct{}) bool {
+			select {
+			case c <- e.(testEvent):
+				return true
+			case <-done:
+				return false
+			}
+		})
+	return s, c
+}
+
+// Push e and wait for the delivery goroutine to take it from the
+// buffer, where it blocks until received.
+func pushTaken(t *testing.T, s *Subscription, e testEvent) {
+	t.Helper()
+	s.push(e)
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		n := len(s.events)
+		s.mu.Unlock()
+		if n == 0 {
+			return
+		}
+	}
+	t.Fatal("event not taken for delivery")
+}
+
+func receive(t *testing.T, c chan testEvent, n int) string {
+	t.Helper()
+	var r string
+	for i := 0; i < n; i++ {
+		select {
+		case e := <-c:
+			if r != "" {
+				r += " "
+			}
+			r += e.String()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %q, want %d events", r, n)
+		}
+	}
+	return r
+}
+
+func TestOverflow(t *testing.T) {
+	a := func(n int) testEvent { return testEvent{"a", n} }
+	b := func(n int) testEvent { return testEvent{"b", n} }
+	x := func(n int) testEvent { return testEvent{"", n} }
+
+	for _, tc := range []struct {
+		name    string
+		o       MonitorOptions
+		push    []testEvent
+		want    string
+		dropped uint64
+	}{
+		{"coalesce with room", MonitorOptions{Buffer: 4},
+			[]testEvent{a(1), a(2), a(3)}, "a0 a1 a2 a3", 0},
+		{"coalesce same key", MonitorOptions{Buffer: 2},
+			[]testEvent{b(1), a(1), a(2)}, "a0 b1 a2", 1},
+		{"coalesce without match", MonitorOptions{Buffer: 2},
+			[]testEvent{a(1), b(1), x(1)}, "a0 b1 1", 1},
+		{"coalesce unkeyed", MonitorOptions{Buffer: 2},
+			[]testEvent{x(1), x(2), x(3)}, "a0 2 3", 1},
+		{"drop oldest", MonitorOptions{Buffer: 2, Overflow: DropOldest},
+			[]testEvent{a(1), a(2), a(3)}, "a0 a2 a3", 1},
+		{"drop newest", MonitorOptions{Buffer: 2, Overflow: DropNewest},
+			[]testEvent{a(1), a(2), a(3), b(1)}, "a0 a1 a2", 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, c := testSubscription(tc.o)
+			defer s.Unsubscribe()
+			pushTaken(t, s, a(0))
+			for _, e := range tc.push {
+				s.push(e)
+			}
+			if d := s.Dropped(); d != tc.dropped {
+				t.Errorf("Dropped() = %d, want %d", d, tc.dropped)
+			}
+			n := 1 + len(tc.push) - int(tc.dropped)
+			if got := receive(t, c, n); got != tc.want {
+				t.Errorf("received %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	s, c := testSubscription(MonitorOptions{Buffer: 1, Overflow: Block})
+	defer s.Unsubscribe()
+	pushTaken(t, s, testEvent{"a", 0})
+	s.push(testEvent{"a", 1})
+
+	pushed := make(chan struct{})
+	go func() {
+		s.push(testEvent{"a", 2})
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push to a full buffer did not block")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	if got := receive(t, c, 1); got != "a0" {
+		t.Errorf("received %q, want a0", got)
+	}
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push still blocked after the buffer drained")
+	}
+	if got := receive(t, c, 2); got != "a1 a2" {
+		t.Errorf("received %q, want a1 a2", got)
+	}
+	if d := s.Dropped(); d != 0 {
+		t.Errorf("Dropped() = %d, want 0", d)
+	}
+}
+
+func TestUnsubscribeWhileBlocked(t *testing.T) {
+	s, c := testSubscription(MonitorOptions{Buffer: 1, Overflow: Block})
+	pushTaken(t, s, testEvent{"a", 0})
+	s.push(testEvent{"a", 1})
+
+	pushed := make(chan struct{})
+	go func() {
+		s.push(testEvent{"a", 2})
+		close(pushed)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	s.Unsubscribe()
+
+	select {
+	case <-pushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("push still blocked after Unsubscribe")
+	}
+	select {
+	case e := <-c:
+		t.Errorf("received %v after Unsubscribe", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.push(testEvent{"a", 3})
+}
@@ -31,14 +31,22 @@ func (s *Switch) Off() chan uint8 {
 
 // Creates a new channel receiving updates when the switch is adjusted.
 // For a switch any non-zero level means "on", while 0 means "off".
+// Updates are delivered as by Dimmer.AddMonitor.
 func (s *Switch) Monitor() chan LevelChange {
 	return s.dimmer.Monitor()
 }
 
 // Adds a channel to receive updates when the dimmer is adjusted.
 // For a switch any non-zero level means "on", while 0 means "off".
-func (s *Switch) AddMonitor(c chan LevelChange) {
-	s.dimmer.AddMonitor(c)
+// Updates are delivered as by Dimmer.AddMonitor.
+func (s *Switch) AddMonitor(c chan LevelChange) *Subscription {
+	return s.dimmer.AddMonitor(c)
+}
+
+// Adds a channel to receive updates when the switch is adjusted, with
+// the buffering and overflow behavior described by o.
+func (s *Switch) Subscribe(c chan LevelChange, o MonitorOptions) *Subscription {
+	return s.dimmer.Subscribe(c, o)
 }
 
 // Get the status of the switch and send it once on the returned channel.
@@ -0,0 +1,80 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"time"
+
+	"github.com/ziutek/telnet"
+)
+
+// Line oriented connection carrying the integration protocol. Dial uses
+// a telnet session with the main repeater; NewConn accepts any transport,
+// such as a Replay of a recorded session.
+type Transport interface {
+	// Read the next line sent by the repeater, without line terminator.
+	ReadLine() (string, error)
+
+	// Write one command to the repeater. The line terminator is
+	// added by the transport.
+	WriteLine(s string) error
+
+	Close() error
+}
+
+// Create a connection over an established transport. The integration
+// protocol is assumed to be logged in and ready for commands. Unlike
+// Dial, the connection is not re-established if the transport fails;
+// event processing stops and waiting callers are released.
+func NewConn(t Transport, opts ...Option) (*Conn, error) {
+	c := newConn(opts)
+	t = c.wrap(t)
+	if err := setup(t); err != nil {
+		t.Close()
+		return nil, err
+	}
+	if err := c.start(t); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Wrap a new transport with any recorder configured by options.
+func (c *Conn) wrap(t Transport) Transport {
+	if c.recorder != nil {
+		t = &recordingTransport{t, c.recorder}
+	}
+	return t
+}
+
+type telnetTransport struct {
+	t *telnet.Conn
+}
+
+func (t *telnetTransport) ReadLine() (string, error) {
+	return t.t.ReadString('\n')
+}
+
+func (t *telnetTransport) WriteLine(s string) error {
+	return sendln(t.t, s)
+}
+
+func (t *telnetTransport) Close() error {
+	return t.t.Close()
+}
+
+func sendln(t *telnet.Conn, s string) error {
+	if err := t.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	buf := make([]byte, len(s)+2)
+	copy(buf, s)
+	buf[len(s)] = '\r'
+	buf[len(s)+1] = '\n'
+	_, err := t.Write(buf)
+	return err
+}
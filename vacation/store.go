@@ -0,0 +1,175 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vacation
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/spearce/lutron"
+	"github.com/spearce/lutron/internal/atomicfile"
+)
+
+// Default length of history kept by a Store.
+const DefaultRetention = 28 * 24 * time.Hour
+
+// Interval between discarding changes older than the retention period.
+const pruneInterval = 24 * time.Hour
+
+// Level change of an output, as recorded and replayed.
+type Change struct {
+	At    time.Time `json:"at"`
+	Id    int       `json:"id"`
+	Level uint8     `json:"level"`
+}
+
+// History of level changes, appended to a file of JSON lines.
+type Store struct {
+	file      string
+	retention time.Duration
+
+	mu      sync.Mutex
+	changes []Change
+	pruned  time.Time // Last time old changes were discarded.
+}
+
+// Open the store in file, creating it if it does not exist. Changes
+// older than retention, or DefaultRetention if 0, are discarded now and
+// then daily by Add.
+func Open(file string, retention time.Duration) (*Store, error) {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	s := &Store{file: file, retention: retention}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		var c Change
+		if err := json.Unmarshal(sc.Bytes(), &c); err != nil {
+			return nil, fmt.Errorf("vacation: %s:%d: %v", file, n, err)
+		}
+		s.changes = append(s.changes, c)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.prune(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Changes recorded since t.
+func (s *Store) Since(t time.Time) []Change {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var r []Change
+	for _, c := range s.changes {
+		if !c.At.Before(t) {
+			r = append(r, c)
+		}
+	}
+	return r
+}
+
+// Append a change to the store. Once a day, changes older than the
+// retention period are also discarded.
+func (s *Store) Add(c Change) error {
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	s.changes = append(s.changes, c)
+	if time.Since(s.pruned) >= pruneInterval {
+		return s.prune()
+	}
+	return nil
+}
+
+// Record level changes made by people, by the repeater's timeclock and
+// by other clients until ctx is done, returning ctx.Err(). Changes
+// made through conn, including those replayed by a Simulator, are not
+// recorded. No change is missed: processing of events from the
+// repeater waits if the file falls behind.
+func (s *Store) Record(ctx context.Context, conn *lutron.Conn) error {
+	levels := make(chan lutron.LevelChange)
+	sub := conn.SubscribeDimmers(levels,
+		lutron.MonitorOptions{Buffer: 64, Overflow: lutron.Block})
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case lc := <-levels:
+			if lc.Stale || lc.Source == lutron.SourceQuery || lc.Source == lutron.SourceCommand {
+				continue
+			}
+			err := s.Add(Change{At: time.Now(), Id: lc.Dimmer.Id(), Level: lc.Level})
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Drop changes older than the retention period, rewriting the file if
+// any were dropped. s.mu must be held.
+func (s *Store) prune() error {
+	now := time.Now()
+	cutoff := now.Add(-s.retention)
+	i := 0
+	for i < len(s.changes) && s.changes[i].At.Before(cutoff) {
+		i++
+	}
+	if i == 0 {
+		s.pruned = now
+		return nil
+	}
+
+	err := atomicfile.Write(s.file, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, c := range s.changes[i:] {
+			if err := enc.Encode(&c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.changes = append([]Change(nil), s.changes[i:]...)
+	s.pruned = now
+	return nil
+}
@@ -0,0 +1,263 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package vacation makes a house look lived in by replaying randomized
+versions of its real lighting usage.
+
+While the house is occupied, a Store records level changes made by
+people (and by the repeater's timeclock or other clients). While it is
+empty, a Simulator picks a recorded day, preferring one falling on the
+same weekday, and replays its changes with each moved by a random
+jitter:
+
+  store, _ := vacation.Open("/var/lib/lutron/usage.jsonl", 0)
+  go store.Record(ctx, conn)
+
+  // Later, when leaving:
+  sim := vacation.NewSimulator(conn, store)
+  sim.QuietStart = 1 * time.Hour  // 01:00
+  sim.QuietEnd = 6 * time.Hour    // 06:00
+  log.Fatal(sim.Run(ctx))
+
+Switches are recorded and replayed like dimmers, at 0 or 100%. No
+output is turned on during quiet hours, and outputs the simulator
+turned on are turned off when quiet hours begin.
+*/
+package vacation
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/spearce/lutron"
+)
+
+// Default largest random shift of a replayed change.
+const DefaultJitter = 20 * time.Minute
+
+// Replays recorded usage.
+type Simulator struct {
+	// Logger recording each replayed change; slog.Default() if nil.
+	Logger *slog.Logger
+
+	// Location of days and quiet hours; time.Local if nil.
+	Location *time.Location
+
+	// Largest time each change is moved earlier or later;
+	// DefaultJitter if 0.
+	Jitter time.Duration
+
+	// Quiet hours, as times since local midnight. May span midnight,
+	// as from 23:00 to 06:00. Disabled if equal.
+	QuietStart time.Duration
+	QuietEnd   time.Duration
+
+	// Outputs replayed; every output in the history if empty.
+	Ids []int
+
+	conn  *lutron.Conn
+	store *Store
+}
+
+// Create a simulator replaying history from store against conn.
+func NewSimulator(conn *lutron.Conn, store *Store) *Simulator {
+	return &Simulator{conn: conn, store: store}
+}
+
+// Changes that would be replayed on the day containing t, in time
+// order. Each call makes a new random choice.
+func (s *Simulator) Plan(t time.Time) []Change {
+	loc := s.location()
+	day := midnight(t.In(loc))
+
+	byDay := make(map[time.Time][]Change)
+	for _, c := range s.store.Since(day.Add(-s.store.retention)) {
+		if !s.controls(c.Id) {
+			continue
+		}
+		d := midnight(c.At.In(loc))
+		if !d.Equal(day) {
+			byDay[d] = append(byDay[d], c)
+		}
+	}
+
+	var same, other []time.Time
+	for d := range byDay {
+		if d.Weekday() == day.Weekday() {
+			same = append(same, d)
+		} else {
+			other = append(other, d)
+		}
+	}
+	pool := same
+	if len(pool) == 0 {
+		pool = other
+	}
+	if len(pool) == 0 {
+		return nil
+	}
+	sort.Slice(pool, func(i, j int) bool { return pool[i].Before(pool[j]) })
+	src := pool[rand.Intn(len(pool))]
+
+	// Move the chosen day onto day, keeping each output's changes in
+	// their recorded order.
+	jitter := s.Jitter
+	if jitter <= 0 {
+		jitter = DefaultJitter
+	}
+	last := make(map[int]time.Time)
+	var r []Change
+	for _, c := range byDay[src] {
+		at := day.Add(c.At.In(loc).Sub(src))
+		at = at.Add(time.Duration(rand.Int63n(int64(2*jitter)+1)) - jitter)
+		if p, ok := last[c.Id]; ok && !at.After(p) {
+			at = p.Add(time.Second)
+		}
+		last[c.Id] = at
+		if c.Level > 0 && s.quiet(at) {
+			continue
+		}
+		r = append(r, Change{At: at, Id: c.Id, Level: c.Level})
+	}
+	sort.SliceStable(r, func(i, j int) bool { return r[i].At.Before(r[j].At) })
+	return r
+}
+
+// Replay history until ctx is done, returning ctx.Err(). When started
+// during the day, each output is first set to the level of its latest
+// change already passed.
+func (s *Simulator) Run(ctx context.Context) error {
+	on := make(map[int]bool)
+	for {
+		now := time.Now().In(s.location())
+		tomorrow := midnight(now).AddDate(0, 0, 1)
+
+		plan := s.Plan(now)
+		for _, c := range latest(plan, now) {
+			if c.Level == 0 || !s.quiet(now) {
+				s.apply(c, on)
+			}
+		}
+
+		var steps []step
+		for _, c := range plan {
+			if c.At.After(now) {
+				steps = append(steps, step{at: c.At, change: c})
+			}
+		}
+		if s.QuietStart != s.QuietEnd {
+			if q := midnight(now).Add(s.QuietStart); q.After(now) {
+				steps = append(steps, step{at: q, quiet: true})
+			}
+		}
+		sort.SliceStable(steps, func(i, j int) bool { return steps[i].at.Before(steps[j].at) })
+		steps = append(steps, step{at: tomorrow})
+
+		for _, st := range steps {
+			t := time.NewTimer(time.Until(st.at))
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			}
+
+			switch {
+			case st.quiet:
+				for id := range on {
+					s.set(id, 0)
+				}
+				on = make(map[int]bool)
+			case !st.at.Equal(tomorrow):
+				s.apply(st.change, on)
+			}
+		}
+	}
+}
+
+// Latest change of each output in plan at or before t, in time order.
+func latest(plan []Change, t time.Time) []Change {
+	last := make(map[int]int)
+	for i, c := range plan {
+		if !c.At.After(t) {
+			last[c.Id] = i
+		}
+	}
+	var r []Change
+	for i, c := range plan {
+		if j, ok := last[c.Id]; ok && i == j {
+			r = append(r, c)
+		}
+	}
+	return r
+}
+
+type step struct {
+	at     time.Time
+	change Change
+	quiet  bool // Start of quiet hours.
+}
+
+// Replay c, tracking in on the outputs left on.
+func (s *Simulator) apply(c Change, on map[int]bool) {
+	s.set(c.Id, c.Level)
+	if c.Level > 0 {
+		on[c.Id] = true
+	} else {
+		delete(on, c.Id)
+	}
+}
+
+func (s *Simulator) set(id int, level uint8) {
+	s.logger().Info("vacation replay", "id", id, "level", level)
+	s.conn.Dimmer(id).SetLevel(level)
+}
+
+func (s *Simulator) controls(id int) bool {
+	if len(s.Ids) == 0 {
+		return true
+	}
+	for _, i := range s.Ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether t is within quiet hours.
+func (s *Simulator) quiet(t time.Time) bool {
+	if s.QuietStart == s.QuietEnd {
+		return false
+	}
+	tod := t.Sub(midnight(t))
+	if s.QuietStart < s.QuietEnd {
+		return tod >= s.QuietStart && tod < s.QuietEnd
+	}
+	return tod >= s.QuietStart || tod < s.QuietEnd
+}
+
+func (s *Simulator) location() *time.Location {
+	if s.Location != nil {
+		return s.Location
+	}
+	return time.Local
+}
+
+func (s *Simulator) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+func midnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
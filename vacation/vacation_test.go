@@ -0,0 +1,150 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vacation
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Wednesday.
+var today = time.Date(2024, 3, 13, 0, 0, 0, 0, time.UTC)
+
+// Change on the day days after today, at clock "15:04".
+func change(days int, clock string, id int, level uint8) Change {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		panic(err)
+	}
+	at := today.AddDate(0, 0, days).Add(time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute)
+	return Change{At: at, Id: id, Level: level}
+}
+
+// Simulator over changes, with negligible jitter.
+func testSimulator(changes ...Change) *Simulator {
+	store := &Store{retention: DefaultRetention, changes: changes}
+	return &Simulator{Location: time.UTC, Jitter: time.Nanosecond, store: store}
+}
+
+func format(changes []Change) string {
+	var r []string
+	for _, c := range changes {
+		r = append(r, fmt.Sprintf("%s %d=%d", c.At.Round(time.Second).Format("Jan 2 15:04"), c.Id, c.Level))
+	}
+	return strings.Join(r, ", ")
+}
+
+func TestPlan(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		ids     []int
+		quiet   [2]time.Duration
+		changes []Change
+		want    string
+	}{
+		{"empty", nil, [2]time.Duration{}, nil, ""},
+		{"same weekday preferred", nil, [2]time.Duration{}, []Change{
+			change(-7, "18:00", 1, 100),
+			change(-7, "22:00", 1, 0),
+			change(-2, "19:00", 2, 50),
+			change(-1, "20:00", 3, 50),
+		}, "Mar 13 18:00 1=100, Mar 13 22:00 1=0"},
+		{"other weekday", nil, [2]time.Duration{}, []Change{
+			change(-2, "19:00", 2, 50),
+		}, "Mar 13 19:00 2=50"},
+		{"today not replayed", nil, [2]time.Duration{}, []Change{
+			change(0, "07:00", 1, 100),
+		}, ""},
+		{"outputs", []int{2}, [2]time.Duration{}, []Change{
+			change(-7, "18:00", 1, 100),
+			change(-7, "19:00", 2, 100),
+		}, "Mar 13 19:00 2=100"},
+		{"quiet hours", nil, [2]time.Duration{23 * time.Hour, 6 * time.Hour}, []Change{
+			change(-7, "22:00", 1, 100),
+			change(-7, "23:30", 1, 0),
+			change(-7, "23:45", 2, 100),
+			change(-7, "05:00", 3, 100),
+			change(-7, "06:00", 3, 0),
+		}, "Mar 13 06:00 3=0, Mar 13 22:00 1=100, Mar 13 23:30 1=0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := testSimulator(tc.changes...)
+			s.Ids = tc.ids
+			s.QuietStart, s.QuietEnd = tc.quiet[0], tc.quiet[1]
+			if got := format(s.Plan(today.Add(12 * time.Hour))); got != tc.want {
+				t.Errorf("Plan() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPlanJitter(t *testing.T) {
+	s := testSimulator(
+		change(-7, "18:00", 1, 100),
+		change(-7, "18:01", 1, 0),
+		change(-7, "18:02", 1, 100))
+	s.Jitter = time.Hour
+	for i := 0; i < 100; i++ {
+		plan := s.Plan(today)
+		if len(plan) != 3 {
+			t.Fatalf("Plan() = %q", format(plan))
+		}
+		for j, c := range plan {
+			if d := c.At.Sub(today.Add(18 * time.Hour)); d < -time.Hour || d > time.Hour+2*time.Minute+2*time.Second {
+				t.Errorf("Plan() = %q, change moved by %v", format(plan), d)
+			}
+			if j > 0 && !c.At.After(plan[j-1].At) {
+				t.Errorf("Plan() = %q, not in time order", format(plan))
+			}
+		}
+		if plan[0].Level != 100 || plan[1].Level != 0 || plan[2].Level != 100 {
+			t.Errorf("Plan() = %q, changes reordered", format(plan))
+		}
+	}
+}
+
+func TestLatest(t *testing.T) {
+	plan := []Change{
+		change(0, "07:00", 1, 100),
+		change(0, "08:00", 2, 50),
+		change(0, "09:00", 1, 0),
+		change(0, "18:00", 2, 0),
+		change(0, "19:00", 3, 100),
+	}
+	want := "Mar 13 08:00 2=50, Mar 13 09:00 1=0"
+	if got := format(latest(plan, today.Add(12*time.Hour))); got != want {
+		t.Errorf("latest() = %q, want %q", got, want)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	for _, tc := range []struct {
+		start, end string
+		at         string
+		want       bool
+	}{
+		{"01:00", "06:00", "00:59", false},
+		{"01:00", "06:00", "01:00", true},
+		{"01:00", "06:00", "05:59", true},
+		{"01:00", "06:00", "06:00", false},
+		{"23:00", "06:00", "22:59", false},
+		{"23:00", "06:00", "23:00", true},
+		{"23:00", "06:00", "00:00", true},
+		{"23:00", "06:00", "05:59", true},
+		{"23:00", "06:00", "06:00", false},
+		{"12:00", "12:00", "12:00", false},
+	} {
+		tod := func(clock string) time.Duration {
+			return change(0, clock, 0, 0).At.Sub(today)
+		}
+		s := &Simulator{QuietStart: tod(tc.start), QuietEnd: tod(tc.end)}
+		if got := s.quiet(change(0, tc.at, 0, 0).At); got != tc.want {
+			t.Errorf("quiet %s-%s at %s = %v, want %v", tc.start, tc.end, tc.at, got, tc.want)
+		}
+	}
+}
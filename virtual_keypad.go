@@ -0,0 +1,283 @@
+// Copyright 2014 Google. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lutron
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Software behavior for the unprogrammed buttons of a keypad. Each
+// bound button runs its handler when pressed, and its LED is kept in
+// sync with the state the button controls: on while a toggled dimmer
+// is above 0, or while the levels of the scene a button last applied
+// still hold. LED states are sent again after the connection to the
+// main repeater is re-established.
+//
+//   v := lutron.NewVirtualKeypad(conn.Keypad(6))
+//   defer v.Close()
+//   v.Toggle(1, conn.Dimmer(12))
+//   v.CycleScenes(2, evening, reading, off)
+//   v.Func(3, func() { log.Print("button 3") })
+//
+// Buttons must be unprogrammed in the RadioRA2 software; the repeater
+// otherwise runs its own programming and controls the LED.
+type VirtualKeypad struct {
+	k      *Keypad
+	events chan Event
+	sub    *Subscription
+	wake   chan struct{}
+	done   chan struct{}
+	exited chan struct{}
+
+	mu       sync.Mutex
+	bindings map[uint8]*binding
+	levels   map[int]uint8
+}
+
+type binding struct {
+	press func()
+	led   func() uint8 // nil if the LED is set by SetLed.
+	state uint8        // State the LED should show.
+	sent  bool         // state has been sent to the repeater.
+}
+
+// Bind buttons of k. Close must be called to release the keypad.
+func NewVirtualKeypad(k *Keypad) *VirtualKeypad {
+	v := &VirtualKeypad{
+		k:        k,
+		events:   make(chan Event),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		exited:   make(chan struct{}),
+		bindings: make(map[uint8]*binding),
+		levels:   make(map[int]uint8),
+	}
+	v.sub = k.Conn.SubscribeEvents(v.events,
+		EventFilter{Types: ButtonEvents | OutputEvents},
+		MonitorOptions{Buffer: 64})
+	k.Conn.AddObserver(virtualKeypadObserver{v})
+	go v.run()
+	return v
+}
+
+// Stop handling presses. LEDs are left in their current state.
+func (v *VirtualKeypad) Close() {
+	v.k.Conn.RemoveObserver(virtualKeypadObserver{v})
+	v.sub.Unsubscribe()
+	close(v.done)
+	<-v.exited
+}
+
+// Toggle d between off and its last level above 0 with Dimmer.Toggle.
+// The LED is on while d is above 0.
+func (v *VirtualKeypad) Toggle(button uint8, d *Dimmer) {
+	v.bind(button, &binding{
+		press: func() { d.Toggle() },
+		led: func() uint8 {
+			if level, ok := v.level(d); ok && level > 0 {
+				return LedOn
+			}
+			return LedOff
+		},
+	})
+	if _, stale, ok := d.CachedLevel(); !ok || stale {
+		d.Level()
+	}
+}
+
+// Apply the next of scenes on each press, starting with the first. The
+// LED is on while the outputs are at the levels of the scene applied
+// last.
+func (v *VirtualKeypad) CycleScenes(button uint8, scenes ...*Scene) {
+	next, current := 0, (*Scene)(nil)
+	v.bind(button, &binding{
+		press: func() {
+			if len(scenes) == 0 {
+				return
+			}
+			s := scenes[next]
+			next = (next + 1) % len(scenes)
+			current = s
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), timeout+s.maxFade())
+				defer cancel()
+				if err := s.Apply(ctx); err != nil {
+					v.k.Conn.log.Warn("lutron virtual keypad scene failed",
+						"keypad", v.k.id, "button", button, "err", err)
+				}
+			}()
+		},
+		led: func() uint8 {
+			if current == nil {
+				return LedOff
+			}
+			for _, o := range current.Outputs {
+				if level, ok := v.level(v.k.Conn.Dimmer(o.Id)); !ok || level != o.Level {
+					return LedOff
+				}
+			}
+			return LedOn
+		},
+	})
+}
+
+// Call f in a new goroutine on each press. The LED is set with SetLed.
+func (v *VirtualKeypad) Func(button uint8, f func()) {
+	v.bind(button, &binding{press: func() { go f() }})
+}
+
+// Set the LED of a button bound with Func to LedOff, LedOn,
+// LedNormalFlash or LedRapidFlash. The state is restored after a
+// reconnect.
+func (v *VirtualKeypad) SetLed(button uint8, state uint8) {
+	v.mu.Lock()
+	if b := v.bindings[button]; b != nil && b.led == nil {
+		b.state, b.sent = state, false
+	}
+	v.mu.Unlock()
+	v.signal()
+}
+
+// Remove the binding of a button.
+func (v *VirtualKeypad) Unbind(button uint8) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.bindings, button)
+}
+
+func (v *VirtualKeypad) bind(button uint8, b *binding) {
+	v.mu.Lock()
+	v.bindings[button] = b
+	v.mu.Unlock()
+	v.signal()
+}
+
+// Ask run to bring LEDs up to date.
+func (v *VirtualKeypad) signal() {
+	select {
+	case v.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (v *VirtualKeypad) reconnected() {
+	v.mu.Lock()
+	for _, b := range v.bindings {
+		b.sent = false
+	}
+	v.mu.Unlock()
+	v.signal()
+}
+
+// Level of d, as last reported to this keypad or cached by d.
+func (v *VirtualKeypad) level(d *Dimmer) (uint8, bool) {
+	v.mu.Lock()
+	level, ok := v.levels[d.id]
+	v.mu.Unlock()
+	if ok {
+		return level, true
+	}
+	level, stale, ok := d.CachedLevel()
+	return level, ok && !stale
+}
+
+func (v *VirtualKeypad) run() {
+	defer close(v.exited)
+	for {
+		select {
+		case e := <-v.events:
+			switch e := e.(type) {
+			case *ButtonEvent:
+				if e.Id() != v.k.id || e.Action != ButtonPress {
+					continue
+				}
+				v.mu.Lock()
+				b := v.bindings[e.Button]
+				v.mu.Unlock()
+				if b == nil {
+					continue
+				}
+				b.press()
+			case *OutputLevelEvent:
+				v.mu.Lock()
+				v.levels[e.Id()] = uint8(e.Level + 0.5)
+				v.mu.Unlock()
+			}
+		case <-v.wake:
+		case <-v.done:
+			return
+		}
+		v.updateLeds()
+	}
+}
+
+// Send LED states that differ from those last sent. States that cannot
+// be queued are retried shortly.
+func (v *VirtualKeypad) updateLeds() {
+	v.mu.Lock()
+	var bound []*binding
+	var ids []uint8
+	for id, b := range v.bindings {
+		bound = append(bound, b)
+		ids = append(ids, id)
+	}
+	v.mu.Unlock()
+
+	retry := false
+	for i, b := range bound {
+		v.mu.Lock()
+		state := b.state
+		v.mu.Unlock()
+		if b.led != nil {
+			state = b.led()
+		}
+
+		v.mu.Lock()
+		send := !b.sent || state != b.state
+		b.state = state
+		v.mu.Unlock()
+		if !send {
+			continue
+		}
+		_, err := v.k.Button(ids[i]).setLed(state)
+		v.mu.Lock()
+		b.sent = err == nil
+		v.mu.Unlock()
+		if err != nil {
+			retry = true
+		}
+	}
+	if retry {
+		time.AfterFunc(v.k.Conn.queue.retryDelay(), v.signal)
+	}
+}
+
+// Longest fade in the scene.
+func (s *Scene) maxFade() time.Duration {
+	var max time.Duration
+	for _, o := range s.Outputs {
+		if o.Fade != nil && *o.Fade > max {
+			max = *o.Fade
+		} else if o.Fade == nil {
+			if f := s.conn.Dimmer(o.Id).DefaultFade(); f > max {
+				max = f
+			}
+		}
+	}
+	return max
+}
+
+// Observer resending LED states after a reconnect.
+type virtualKeypadObserver struct {
+	v *VirtualKeypad
+}
+
+func (virtualKeypadObserver) CommandSent(string, time.Duration)               {}
+func (virtualKeypadObserver) EventReceived(Event)                             {}
+func (virtualKeypadObserver) LevelAcknowledged(*Dimmer, uint8, time.Duration) {}
+func (o virtualKeypadObserver) Reconnected()                                  { o.v.reconnected() }